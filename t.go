@@ -2,30 +2,197 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"slices"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
 	"time"
 )
 
 const (
 	dateTimeFormat = "2006-01-02 15:04:05"
 	dateFormat     = "2006-01-02"
-	endOfDatePos   = 21
+	// switchGap is the largest gap between an 'o' and the following 'i' for
+	// the pair to be treated as a single switch
+	switchGap = time.Second
+	// hookTimeout bounds how long a TT_HOOK script may run
+	hookTimeout = 10 * time.Second
+	// fixSortMargin is how far out of order an entry may be for
+	// validate -fix to re-sort it
+	fixSortMargin = 10 * time.Minute
+	// usageWindow is how far back project use is counted in the picker
+	usageWindow = 30 * 24 * time.Hour
+	// httpTimeout bounds fetching a timelog given as a URL
+	httpTimeout = 10 * time.Second
+	// reportSchemaVersion is bumped whenever the -json report's shape
+	// changes incompatibly
+	reportSchemaVersion = 1
+	// maxLineLength is the longest line, with its note, that can be read
+	maxLineLength = 1 << 20
 )
 
-var timeLogFile string
+// commands are the action names, used to tell them apart from projects and
+// filenames on the command line
+var commands = []string{"in", "out", "sw", "switch", "cur", "st", "last", "hours", "td", "hoursago", "yd", "thisweek", "tw", "validate", "edit", "timelog", "undo", "watch", "config", "shift", "rename-day", "prune-duplicates", "agg", "stint", "export", "fix-order", "month", "projects", "contexts", "backup", "import", "recent", "switches", "clone-day", "schema", "init"}
+
+var (
+	timeLogFile string
+	force       bool
+	depth       int
+	weekday     string
+	weeks       = 4
+	weekdayAvg  bool
+
+	includeOpenAs   string
+	reportFormat    string
+	daily           bool
+	runningTotal    bool
+	csvOutput       bool
+	groupBy         string
+	note            string
+	minDuration     time.Duration
+	verbose         bool
+	aggBy           = "week"
+	aggLast         = 12
+	stintGap        = 5 * time.Minute
+	workdaysOnly    bool
+	weekendFlag     string
+	excludeWeekends bool
+	billUnit        time.Duration
+	// billRate is the -rate for projects without one in rates, the
+	// -rate-file; with either, reports end with what the hours come to
+	billRate        float64
+	rates           map[string]float64
+	currencyFlag    string
+	roundTo         time.Duration
+	roundDir        = "nearest"
+	subProject      bool
+	projectRegex    *regexp.Regexp
+	gitBranch       bool
+	recent          int
+	displayZone     *time.Location
+	carryover       bool
+	targetHours     float64
+	byFrequency     bool
+	jsonOutput      bool
+	jsonIndent      bool
+	caps            = map[string]float64{}
+	dayBoundaryFlag string
+	ignoreCase      bool
+	normalizeCase   bool
+	// timestampFormat is the layout new entries are written with; entries
+	// in it or in dateTimeFormat are read
+	timestampFormat = dateTimeFormat
+	rolling         int
+	fix             bool
+	notifyAfter     time.Duration
+	notifyEvery     time.Duration
+	excludedDates   = map[string]bool{}
+	switchIfOpen    bool
+	quantiles       []float64
+	contextName     string
+	countSessions   bool
+	// minSessionForStats leaves shorter sessions out of session counts and
+	// averages while still adding them to hours
+	minSessionForStats time.Duration
+	keepBackups        int
+	tsvOutput          bool
+	// excludeOpenProject leaves the open session out of reports when it is on
+	// this project or under it
+	excludeOpenProject string
+	// dayTargets are the -target-from-file targets, by date and weekday
+	dayTargets *targetFile
+	// matchingDays makes -project-regex pick days rather than sessions
+	matchingDays bool
+	// resumeOrClose lets in offer to close a session left open longer than
+	// stale_after, at closeAt if given
+	resumeOrClose  bool
+	staleAfterFlag string
+	closeAt        string
+	// combineAdjacent merges sessions of one project less than combine_gap
+	// apart into one, for -detail and -count-sessions
+	combineAdjacent bool
+	combineGapFlag  string
+	// cacheFlag turns the parsed entry cache "on" or "off" for this run
+	cacheFlag string
+	// strict makes validate print each problem as file:line: message and
+	// fail, stopping after maxIssues of them if that's set
+	strict       bool
+	maxIssues    = 1
+	strictIssues int
+	// aliasesFlag is the -project-aliases file of old = canonical names
+	aliasesFlag string
+	// outAll makes out a recovery action that closes any open session
+	outAll bool
+	// weekStartFlag is the day weeks start on for tw, lw and agg
+	weekStartFlag string
+	// datesFlag is "relative" or "absolute", for how recent and switches
+	// show dates
+	datesFlag string
+	// weekGoalFlag is the -goal for tw's progress bar, in hours
+	weekGoalFlag string
+	// minutes shows report totals in whole minutes instead of hours
+	minutes bool
+	// detail lists a day's sessions before its td/yd total
+	detail bool
+	// weekNumbers prefixes each day of -daily reports with its ISO week
+	weekNumbers bool
+	// fillGapsAs names the project reports put unlogged time in the
+	// working window under
+	fillGapsAs     string
+	workWindowFlag string
+	// asOf, when set, is the moment reports are run as of instead of now
+	asOf    time.Time
+	asOfArg string
+	// outputPath, when set, is the file output goes to instead of stdout
+	outputPath string
+	// entryAt, when set, is the time clock commands record instead of now
+	entryAt   time.Time
+	fullPaths bool
+	// summaryOnly limits grouped reports to top level projects
+	summaryOnly bool
+	quiet       bool
+	importFrom  = "toggl"
+	importMap   = "project"
+)
+
+// openShare is how much of the last hoursForRange total came from the
+// session still open, and the project and date it was counted under
+type openShare struct {
+	duration time.Duration
+	project  string
+	date     string
+}
+
+var openIncluded openShare
 
 // Entry represents a parsed log entry
 type Entry struct {
-	Project  string
-	Segments []string
-	Hours    float64
+	Project  string   `json:"project"`
+	Segments []string `json:"segments"`
+	Hours    float64  `json:"hours"`
+	Date     string   `json:"date"`
+	Note     string   `json:"note,omitempty"`
 }
 
 func main() {
@@ -45,18 +212,426 @@ func main() {
 	// Parse flags and arguments, allowing flags anywhere
 	for i := 1; i < len(os.Args); i++ {
 		arg := os.Args[i]
+		if strings.HasPrefix(arg, "--") {
+			arg = arg[1:]
+		}
 		switch arg {
 		case "-g", "-group":
 			group = true
 		case "-g-", "-group-":
 			group = false
-		case "-file":
+		case "-force":
+			force = true
+		case "-depth":
+			if i+1 < len(os.Args) {
+				fmt.Sscanf(os.Args[i+1], "%d", &depth)
+				i++
+			}
+		case "-weekday":
+			if i+1 < len(os.Args) {
+				weekday = os.Args[i+1]
+				i++
+			}
+		case "-per-weekday-avg":
+			weekdayAvg = true
+		case "-weeks":
+			if i+1 < len(os.Args) {
+				fmt.Sscanf(os.Args[i+1], "%d", &weeks)
+				i++
+			}
+		case "-output":
+			if i+1 < len(os.Args) {
+				outputPath = os.Args[i+1]
+				i++
+			}
+		case "-as-of":
+			if i+1 < len(os.Args) {
+				asOfArg = os.Args[i+1]
+				i++
+			}
+		case "-include-open-as":
+			if i+1 < len(os.Args) {
+				includeOpenAs = os.Args[i+1]
+				i++
+			}
+		case "-v", "-verbose":
+			verbose = true
+		case "-min-duration":
+			if i+1 < len(os.Args) {
+				d, err := time.ParseDuration(os.Args[i+1])
+				if err != nil {
+					fmt.Println("Invalid -min-duration:", err)
+					os.Exit(1)
+				}
+				minDuration = d
+				i++
+			}
+		case "-project-regex":
+			if i+1 < len(os.Args) {
+				re, err := regexp.Compile(os.Args[i+1])
+				if err != nil {
+					fmt.Println("Invalid -project-regex:", err)
+					os.Exit(1)
+				}
+				projectRegex = re
+				i++
+			}
+		case "-stint-gap":
+			if i+1 < len(os.Args) {
+				d, err := time.ParseDuration(os.Args[i+1])
+				if err != nil {
+					fmt.Println("Invalid -stint-gap:", err)
+					os.Exit(1)
+				}
+				stintGap = d
+				i++
+			}
+		case "-sub":
+			subProject = true
+		case "-unit":
+			if i+1 < len(os.Args) {
+				d, err := time.ParseDuration(os.Args[i+1])
+				if err != nil {
+					fmt.Println("Invalid -unit:", err)
+					os.Exit(1)
+				}
+				billUnit = d
+				i++
+			}
+		case "-rate":
+			if i+1 < len(os.Args) {
+				rate, err := strconv.ParseFloat(os.Args[i+1], 64)
+				if err != nil || rate < 0 {
+					fmt.Println("Invalid -rate:", os.Args[i+1])
+					os.Exit(1)
+				}
+				billRate = rate
+				i++
+			}
+		case "-rate-file":
+			if i+1 < len(os.Args) {
+				r, err := readRateFile(os.Args[i+1])
+				if err != nil {
+					fmt.Println("Invalid -rate-file:", err)
+					os.Exit(1)
+				}
+				rates = r
+				i++
+			}
+		case "-currency":
+			if i+1 < len(os.Args) {
+				currencyFlag = os.Args[i+1]
+				i++
+			}
+		case "-round":
+			if i+1 < len(os.Args) {
+				d, err := time.ParseDuration(os.Args[i+1])
+				if err != nil || d <= 0 {
+					fmt.Println("Invalid -round:", os.Args[i+1])
+					os.Exit(1)
+				}
+				roundTo = d
+				i++
+			}
+		case "-round-dir":
+			if i+1 < len(os.Args) {
+				roundDir = os.Args[i+1]
+				if roundDir != "floor" && roundDir != "ceil" && roundDir != "nearest" {
+					fmt.Printf("Invalid -round-dir %q, expected floor, ceil or nearest\n", roundDir)
+					os.Exit(1)
+				}
+				i++
+			}
+		case "-floor":
+			roundDir = "floor"
+		case "-ceil":
+			roundDir = "ceil"
+		case "-exclude-weekends":
+			excludeWeekends = true
+		case "-workdays-only":
+			workdaysOnly = true
+		case "-weekend":
+			if i+1 < len(os.Args) {
+				weekendFlag = os.Args[i+1]
+				i++
+			}
+		case "-by":
+			if i+1 < len(os.Args) {
+				aggBy = os.Args[i+1]
+				i++
+			}
+		case "-last":
+			if i+1 < len(os.Args) {
+				fmt.Sscanf(os.Args[i+1], "%d", &aggLast)
+				i++
+			}
+		case "-group-by":
+			if i+1 < len(os.Args) {
+				groupBy = os.Args[i+1]
+				i++
+			}
+		case "-note":
+			if i+1 < len(os.Args) {
+				note = os.Args[i+1]
+				i++
+			}
+		case "-recent":
+			if i+1 < len(os.Args) {
+				fmt.Sscanf(os.Args[i+1], "%d", &recent)
+				i++
+			}
+		case "-tz-display":
+			if i+1 < len(os.Args) {
+				loc, err := time.LoadLocation(os.Args[i+1])
+				if err != nil {
+					fmt.Println("Invalid -tz-display:", err)
+					os.Exit(1)
+				}
+				displayZone = loc
+				i++
+			}
+		case "-git-branch":
+			gitBranch = true
+		case "-csv":
+			csvOutput = true
+		case "-tsv":
+			csvOutput, tsvOutput = true, true
+		case "-json":
+			jsonOutput = true
+		case "-json-pretty":
+			jsonOutput, jsonIndent = true, true
+		case "-daily":
+			daily = true
+		case "-running-total":
+			runningTotal = true
+		case "-frequency":
+			byFrequency = true
+		case "-mru":
+			byFrequency = false
+		case "-cap":
+			if i+1 < len(os.Args) {
+				name, limit, ok := strings.Cut(os.Args[i+1], "=")
+				hours, err := strconv.ParseFloat(strings.TrimSpace(limit), 64)
+				if !ok || err != nil || strings.TrimSpace(name) == "" {
+					fmt.Printf("Invalid -cap %q, expected project=hours\n", os.Args[i+1])
+					os.Exit(1)
+				}
+				caps[strings.Join(projectSegments(name), ":")] = hours
+				i++
+			}
+		case "-exclude-open-project":
+			if i+1 < len(os.Args) {
+				excludeOpenProject = os.Args[i+1]
+				i++
+			}
+		case "-target-from-file":
+			if i+1 < len(os.Args) {
+				targets, err := readTargetFile(os.Args[i+1])
+				if err != nil {
+					fmt.Println("Invalid -target-from-file:", err)
+					os.Exit(1)
+				}
+				dayTargets = targets
+				i++
+			}
+		case "-sum-only-matching-days":
+			matchingDays = true
+		case "-resume-or-close":
+			resumeOrClose = true
+		case "-stale-after":
+			if i+1 < len(os.Args) {
+				staleAfterFlag = os.Args[i+1]
+				i++
+			}
+		case "-combine-adjacent":
+			combineAdjacent = true
+		case "-combine-gap":
+			if i+1 < len(os.Args) {
+				combineGapFlag = os.Args[i+1]
+				i++
+			}
+		case "-close-at":
+			if i+1 < len(os.Args) {
+				closeAt = os.Args[i+1]
+				i++
+			}
+		case "-cache":
+			cacheFlag = "on"
+		case "-no-cache":
+			cacheFlag = "off"
+		case "-strict":
+			strict = true
+		case "-max-issues":
+			if i+1 < len(os.Args) {
+				fmt.Sscanf(os.Args[i+1], "%d", &maxIssues)
+				i++
+			}
+		case "-project-aliases":
+			if i+1 < len(os.Args) {
+				aliasesFlag = os.Args[i+1]
+				i++
+			}
+		case "-all":
+			outAll = true
+		case "-relative-dates":
+			datesFlag = "relative"
+		case "-absolute-dates":
+			datesFlag = "absolute"
+		case "-week-start":
+			if i+1 < len(os.Args) {
+				weekStartFlag = os.Args[i+1]
+				i++
+			}
+		case "-end-of-week":
+			// a week ending on a day starts on the one after
+			if i+1 < len(os.Args) {
+				d, err := parseWeekday(os.Args[i+1])
+				if err != nil {
+					fmt.Println("Invalid -end-of-week:", err)
+					os.Exit(1)
+				}
+				weekStartFlag = ((d + 1) % 7).String()
+				i++
+			}
+		case "-goal":
+			if i+1 < len(os.Args) {
+				weekGoalFlag = os.Args[i+1]
+				i++
+			}
+		case "-minutes":
+			minutes = true
+		case "-detail":
+			detail = true
+		case "-week-numbers":
+			weekNumbers = true
+		case "-fill-gaps-as":
+			if i+1 < len(os.Args) {
+				fillGapsAs = os.Args[i+1]
+				i++
+			}
+		case "-work-window":
+			if i+1 < len(os.Args) {
+				workWindowFlag = os.Args[i+1]
+				i++
+			}
+		case "-day-boundary":
+			if i+1 < len(os.Args) {
+				dayBoundaryFlag = os.Args[i+1]
+				i++
+			}
+		case "-normalize-case":
+			normalizeCase = true
+		case "-ignore-case":
+			ignoreCase = true
+		case "-notify", "-every":
+			if i+1 < len(os.Args) {
+				d, err := time.ParseDuration(os.Args[i+1])
+				if err != nil {
+					fmt.Printf("Invalid %s: %v\n", arg, err)
+					os.Exit(1)
+				}
+				if arg == "-notify" {
+					notifyAfter = d
+				} else {
+					notifyEvery = d
+				}
+				i++
+			}
+		case "-exclude-dates":
+			if i+1 < len(os.Args) {
+				dates, err := readDateFile(os.Args[i+1])
+				if err != nil {
+					fmt.Println("Invalid -exclude-dates:", err)
+					os.Exit(1)
+				}
+				excludedDates = dates
+				i++
+			}
+		case "-quantile":
+			// the list of quantiles is optional
+			quantiles = []float64{0.25, 0.5, 0.75, 0.9}
+			if i+1 < len(os.Args) {
+				if qs, err := parseQuantiles(os.Args[i+1]); err == nil {
+					quantiles = qs
+					i++
+				}
+			}
+		case "-context":
+			if i+1 < len(os.Args) {
+				contextName = os.Args[i+1]
+				if contextName == "" || strings.ContainsAny(contextName, `/\.*?[`) {
+					fmt.Printf("Invalid -context %q: use a plain name\n", contextName)
+					os.Exit(1)
+				}
+				i++
+			}
+		case "-keep":
+			if i+1 < len(os.Args) {
+				fmt.Sscanf(os.Args[i+1], "%d", &keepBackups)
+				i++
+			}
+		case "-from":
+			if i+1 < len(os.Args) {
+				importFrom = os.Args[i+1]
+				i++
+			}
+		case "-map":
+			if i+1 < len(os.Args) {
+				importMap = os.Args[i+1]
+				i++
+			}
+		case "-q":
+			quiet = true
+		case "-project-summary-only":
+			summaryOnly = true
+			group = true
+		case "-full-paths":
+			fullPaths = true
+		case "-count-sessions":
+			countSessions = true
+		case "-min-session-for-stats":
+			if i+1 < len(os.Args) {
+				d, err := time.ParseDuration(os.Args[i+1])
+				if err != nil {
+					fmt.Println("Invalid -min-session-for-stats:", err)
+					os.Exit(1)
+				}
+				minSessionForStats = d
+				i++
+			}
+		case "-switch-if-open":
+			switchIfOpen = true
+		case "-fix":
+			fix = true
+		case "-rolling":
+			if i+1 < len(os.Args) {
+				fmt.Sscanf(os.Args[i+1], "%d", &rolling)
+				i++
+			}
+		case "-carryover":
+			carryover = true
+		case "-target":
+			if i+1 < len(os.Args) {
+				fmt.Sscanf(os.Args[i+1], "%g", &targetHours)
+				i++
+			}
+		case "-format":
+			if i+1 < len(os.Args) {
+				if os.Args[i+1] == "tsv" {
+					csvOutput, tsvOutput = true, true
+				} else {
+					reportFormat = os.Args[i+1]
+				}
+				i++
+			}
+		case "-file", "-path":
 			if i+1 < len(os.Args) {
 				file = os.Args[i+1]
 				i++
 			}
 		default:
-			if strings.HasPrefix(arg, "-") {
+			// Negative numbers are day offsets, not flags
+			if strings.HasPrefix(arg, "-") && !isInteger(arg) {
 				// Unknown flag, skip
 				continue
 			}
@@ -71,14 +646,60 @@ func main() {
 		}
 	}
 
-	if f := os.Getenv("TIMELOG"); f != "" {
-		timeLogFile = f
+	// A leading timestamp, quoted or as date and time arguments, backdates
+	// a clock command. Take it out before the filename check below.
+	timestampFormat = resolveTimestampFormat()
+	if _, err := weekStart(); err != nil {
+		fmt.Println("Invalid week start:", err)
+		os.Exit(1)
+	}
+	if dates := resolveSetting("dates", datesFlag, "TT_DATES", "absolute").Value; dates != "absolute" && dates != "relative" {
+		fmt.Printf("Invalid dates %q: expected absolute or relative\n", dates)
+		os.Exit(1)
+	}
+	if asOfArg != "" {
+		t, err := parseTimestampArg(asOfArg)
+		if err != nil {
+			fmt.Println("Invalid -as-of:", err)
+			os.Exit(1)
+		}
+		if action == "in" || action == "out" || action == "sw" || action == "switch" || action == "undo" {
+			fmt.Println("-as-of is for reports and can't be used with", action)
+			os.Exit(1)
+		}
+		asOf = t
+	}
+	if outputPath != "" {
+		f, err := createOutput(outputPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Can't write -output:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		os.Stdout = f
+	}
+	if action == "in" || action == "out" || action == "sw" || action == "switch" {
+		for n := min(2, len(args)); n > 0; n-- {
+			if t, err := parseTimestampArg(strings.Join(args[:n], " ")); err == nil {
+				entryAt = t
+				args = args[n:]
+				object = ""
+				if len(args) > 0 {
+					object = args[0]
+				}
+				break
+			}
+		}
 	}
-	commands := []string{"in", "out", "sw", "switch", "cur", "st", "last", "hours", "td", "hoursago", "yd", "thisweek", "tw", "validate", "edit", "timelog"}
-	// If file not set, check if last arg is a filename (not an action or flag)
-	if file == "" && len(args) > 0 &&
+
+	// If file not set, check if last arg is a filename (not an action or flag).
+	// Numbers and dates are day counts or project names, never files. The
+	// clock commands take every word as the project, so they need -file.
+	clockAction := action == "in" || action == "out" || action == "sw" || action == "switch"
+	if file == "" && len(args) > 0 && !clockAction &&
 		!strings.HasPrefix(args[len(args)-1], "-") &&
 		!isInteger(args[len(args)-1]) &&
+		!isDate(args[len(args)-1]) &&
 		!slices.Contains(commands, args[len(args)-1]) &&
 		args[len(args)-1] != object &&
 		!strings.HasPrefix(args[len(args)-1], "last") &&
@@ -122,11 +743,27 @@ func main() {
 	case "in", "sw", "switch":
 		// fmt.Printf("jh args %v\n", args)
 		lastType, err := lastEntryType()
-		if err != nil {
+		// a missing log is an empty one, which can be clocked into
+		if err != nil && !(action == "in" && errors.Is(err, os.ErrNotExist)) {
 			fmt.Println("Error reading last entry:", err)
 			os.Exit(1)
 		}
-		if action == "in" && lastType != "o" {
+		// with -switch-if-open an in while clocked in becomes a switch
+		switched := action == "in" && lastType == "i" && switchIfOpen
+		if switched {
+			action = "sw"
+		}
+		if action == "in" && lastType == "i" && resumeOrClose {
+			closed, err := offerStaleClose()
+			if err != nil {
+				printError(err)
+				os.Exit(1)
+			}
+			if closed {
+				lastType = "o"
+			}
+		}
+		if action == "in" && lastType != "o" && lastType != "" {
 			fmt.Println("Cannot clock in: last entry is not an 'o' (out) entry.")
 			os.Exit(1)
 		}
@@ -145,36 +782,83 @@ func main() {
 
 		var project string
 		if len(args) > 0 {
-			project = strings.Join(args, " ")
+			project = joinProjectArgs(args)
+		} else if recent > 0 {
+			// pick from the same list as the menu, without prompting
+			projects, err := lastNProjects(recent, excludeProject)
+			if err != nil {
+				printError(err)
+				os.Exit(1)
+			}
+			if recent > len(projects) {
+				fmt.Printf("Only %d recent projects, can't pick number %d.\n", len(projects), recent)
+				os.Exit(1)
+			}
+			project = projects[recent-1].Project
+		} else if p := defaultProject(); p != "" {
+			project = p
 		} else {
 			projects, err := lastNProjects(10, excludeProject)
-			if err != nil || len(projects) == 0 {
-				fmt.Println("No previous projects found.")
+			if (err == nil || errors.Is(err, os.ErrNotExist)) && len(projects) == 0 && action == "in" {
+				// nothing to pick from yet, so ask for the first project
+				fmt.Print("No previous projects. Enter a project name: ")
+				name, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+				if project = strings.TrimSpace(name); project == "" {
+					fmt.Printf("No project given; use '%s in <project>'.\n", filepath.Base(os.Args[0]))
+					os.Exit(1)
+				}
+			} else if err != nil || len(projects) == 0 {
+				fmt.Printf("No previous projects found; use '%s %s <project>'.\n", filepath.Base(os.Args[0]), action)
 				os.Exit(1)
+			} else {
+				fmt.Println("Select a project:")
+				for i, p := range projects {
+					fmt.Printf("%d: %s (%dx, %s)\n", i+1, p.Project, p.Count, relativeDay(p.LastUsed))
+				}
+				fmt.Print("Enter number: ")
+				var choice int
+				_, err = fmt.Scanf("%d", &choice)
+				if err != nil || choice < 1 || choice > len(projects) {
+					fmt.Println("Invalid selection.")
+					os.Exit(1)
+				}
+				project = projects[choice-1].Project
 			}
-			fmt.Println("Select a project:")
-			for i, p := range projects {
-				fmt.Printf("%d: %s\n", i+1, p)
-			}
-			fmt.Print("Enter number: ")
-			var choice int
-			_, err = fmt.Scanf("%d", &choice)
-			if err != nil || choice < 1 || choice > len(projects) {
-				fmt.Println("Invalid selection.")
+		}
+		// "@name" stands for a template from the config
+		if name, ok := strings.CutPrefix(project, "@"); ok {
+			p, templateNote, err := expandTemplate(name)
+			if err != nil {
+				printError(err)
 				os.Exit(1)
 			}
-			project = projects[choice-1]
+			project = p
+			if note == "" {
+				note = templateNote
+			}
+		}
+		project = normalizeProject(project)
+		// "tt in out" is almost always a mistyped command, not a project
+		if slices.Contains(commands, project) && !force {
+			fmt.Printf("%q is a command name; use -force to clock into a project called that.\n", project)
+			os.Exit(1)
+		}
+		if current, _ := currentProject(); switched && current == project {
+			fmt.Println("Already clocked in to", project)
+			return
 		}
 		if action == "in" {
 			if err := clockIn(project); err != nil {
-				fmt.Println("Error:", err)
+				printError(err)
 				os.Exit(1)
 			}
+			runHook("in", project)
 		} else {
 			if err := switchProject(project); err != nil {
-				fmt.Println("Error:", err)
+				printError(err)
 				os.Exit(1)
 			}
+			runHook("sw", project)
 		}
 	case "out":
 		lastType, err := lastEntryType()
@@ -182,567 +866,4474 @@ func main() {
 			fmt.Println("Error reading last entry:", err)
 			os.Exit(1)
 		}
+		if lastType != "i" && outAll {
+			fmt.Println("Nothing to close.")
+			return
+		}
 		if lastType != "i" {
 			fmt.Println("Cannot out: last entry is not an 'i' (in) entry.")
 			os.Exit(1)
 		}
+		if outAll {
+			// even with -force, never end a session before it started
+			project, start, open, err := openSession()
+			if err == nil && open && clockNow().Before(start) {
+				fmt.Printf("Cannot out: %s would be before %s started at %s.\n", clockNow().Format(dateTimeFormat), project, start.Format(dateTimeFormat))
+				os.Exit(1)
+			}
+		}
 
-		project := strings.Join(args, " ")
+		closed, _ := currentProject()
+		project := normalizeProject(strings.Join(args, " "))
 		if err := clockOut(project); err != nil {
-			fmt.Println("Error:", err)
+			printError(err)
 			os.Exit(1)
 		}
+		runHook("out", closed)
+		if outAll {
+			fmt.Printf("Clocked out of %s at %s\n", closed, clockNow().Format("15:04:05"))
+		}
 	case "cur", "st":
 		if proj, err := currentProject(); err == nil {
 			fmt.Println(proj)
 		} else {
-			fmt.Println("Error:", err)
+			printError(err)
 		}
 	case "hours", "td":
+		if weekday != "" {
+			if err := reportWeekday(weekday, weeks); err != nil {
+				printError(err)
+				os.Exit(1)
+			}
+			return
+		}
+		if weekdayAvg {
+			if err := reportWeekdayAverages(weeks); err != nil {
+				printError(err)
+				os.Exit(1)
+			}
+			return
+		}
 		hours, _, _, entries, err := hoursToday(group)
+		if err == nil && detail {
+			err = displayDayDetail(0)
+		}
+		if err == nil {
+			err = printReport("Hours worked today", hours, entries, group)
+		}
 		if err != nil {
-			fmt.Println("Error:", err)
-		} else if group {
-			DisplayHierTotals(entries)
-		} else {
-			fmt.Printf("Hours worked today: %.2f\n", hours)
+			printError(err)
 		}
 	case "thisweek", "tw":
+		if daily || runningTotal || carryover {
+			if err := reportDays(weekRange(0)); err != nil {
+				printError(err)
+			}
+			return
+		}
 		hours, _, _, entries, err := hoursThisWeek(group)
+		if err == nil {
+			err = printReport("Hours worked this week", hours, entries, group)
+		}
+		if err == nil && reportFormat == "" && !csvOutput && !jsonOutput {
+			err = displayGoalBar(hours)
+		}
 		if err != nil {
-			fmt.Println("Error:", err)
-		} else if group {
-			DisplayHierTotals(entries)
-		} else {
-			fmt.Printf("Hours worked this week: %.2f\n", hours)
+			printError(err)
 		}
-	case "edit":
-		editTimelog()
-		os.Exit(1)
-	case "timelog":
-		fmt.Println(getTimelogFile())
-		os.Exit(1)
-	case "validate":
-		if err := validateTimelogFile(getTimelogFile()); err != nil {
-			fmt.Println("Validation error:", err)
+	case "watch":
+		if err := watchSession(); err != nil {
+			printError(err)
 			os.Exit(1)
 		}
-		return
-	default:
-		usage()
-	}
-}
-
-func usage() {
-	prog := filepath.Base(os.Args[0])
-	fmt.Printf(`Usage: %s <action> [project] [options] [filename]
-Actions:
-  in <project>      - clock into project (only if last entry is 'o')
-  out <project>     - clock out of project (only if last entry is 'i')
-  sw <project>      - switch projects (only if last entry is 'i')
-  cur               - show currently open project
-  last              - show last closed project
+	case "shift", "rename-day":
+		if len(args) < 2 {
+			fmt.Println("Usage: shift <date> <newdate>")
+			os.Exit(1)
+		}
+		if err := shiftDay(args[0], args[1], false); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "clone-day":
+		if len(args) < 2 {
+			fmt.Println("Usage: clone-day <date> <newdate>")
+			os.Exit(1)
+		}
+		if err := shiftDay(args[0], args[1], true); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "fix-order":
+		if err := fixOrder(); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "export":
+		weeksAgo := 0
+		if len(args) > 0 {
+			fmt.Sscanf(args[0], "%d", &weeksAgo)
+		}
+		hours, _, _, entries, err := hoursForWeek(weeksAgo, true)
+		if err == nil {
+			if reportFormat == "" {
+				reportFormat = "markdown"
+			}
+			err = printReport("Hours worked", hours, entries, true)
+		}
+		if err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "month":
+		monthsAgo := 0
+		if len(args) > 0 {
+			fmt.Sscanf(args[0], "%d", &monthsAgo)
+		}
+		if err := reportMonthGrid(monthsAgo); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "recent":
+		n := 5
+		if len(args) > 0 {
+			fmt.Sscanf(args[0], "%d", &n)
+		}
+		if err := showRecent(max(1, n)); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "import":
+		if len(args) < 1 {
+			fmt.Println("Usage: import -from toggl <file.csv>")
+			os.Exit(1)
+		}
+		if importFrom != "toggl" {
+			fmt.Printf("Error: can't import from %q, only toggl\n", importFrom)
+			os.Exit(1)
+		}
+		if err := importToggl(args[0], importMap); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "backup":
+		path, err := backupTimelog()
+		if err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+		fmt.Println("Backed up to", path)
+	case "contexts":
+		weeksAgo := 0
+		if len(args) > 0 {
+			fmt.Sscanf(args[0], "%d", &weeksAgo)
+		}
+		if err := reportContexts(weeksAgo); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "projects":
+		days := 0
+		if len(args) > 0 {
+			fmt.Sscanf(args[0], "%d", &days)
+		}
+		if err := displayProjectTree(days); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "init":
+		if err := initTimelog(); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "schema":
+		if err := printSchemas(); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "switches":
+		days := 1
+		if len(args) > 0 {
+			fmt.Sscanf(args[0], "%d", &days)
+		}
+		if err := reportSwitches(max(1, days)); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "stint":
+		if err := reportStint(stintGap); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "agg":
+		if err := reportAggregate(aggBy, aggLast); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "prune-duplicates":
+		if err := pruneDuplicates(); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "undo":
+		if err := undoLast(); err != nil {
+			printError(err)
+			os.Exit(1)
+		}
+	case "edit":
+		editTimelog()
+		os.Exit(1)
+	case "timelog":
+		fmt.Println(getTimelogFile())
+		os.Exit(1)
+	case "config":
+		printConfig()
+	case "validate":
+		if fix {
+			if err := fixTimelog(); err != nil {
+				fmt.Println("Validation error:", err)
+				os.Exit(1)
+			}
+			return
+		}
+		paths, err := timelogPaths()
+		if err != nil {
+			fmt.Println("Validation error:", err)
+			os.Exit(1)
+		}
+		for _, path := range paths {
+			if len(paths) > 1 && !strict {
+				fmt.Println(path + ":")
+			}
+			if err := validateTimelogFile(path); errors.Is(err, errTooManyIssues) {
+				break
+			} else if err != nil {
+				fmt.Println("Validation error:", err)
+				os.Exit(1)
+			}
+		}
+		if strictIssues > 0 {
+			os.Exit(1)
+		}
+		return
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	prog := filepath.Base(os.Args[0])
+	fmt.Printf(`Usage: %s <action> [project] [options] [filename]
+Actions:
+  in <project>      - clock into project (only if last entry is 'o')
+  out <project>     - clock out of project (only if last entry is 'i')
+  sw <project>      - switch projects (only if last entry is 'i')
+  out -all          - close the open session, if any, as a recovery step;
+                      says so rather than failing when nothing is open
+  cur               - show currently open project
+  last              - show last closed project
   hours/td          - show hours worked today
   hoursago/yd       - show hours worked N days ago
   thisweek          - show hours worked this week
   yd                - show hours for yesterday
   lw                - show hours for last week
-  validate          - validate timelog file for out-of-order entries
+  validate          - validate timelog file for out-of-order or overlapping entries
+  validate -strict  - print each problem as file:line: message and exit 1 if
+                      any; stops after the first unless -max-issues n (0
+                      for all)
+  validate -fix     - trim whitespace, drop blank lines and re-sort entries up to
+                      10m out of order, after taking a backup
+  undo              - revert the last in, out or switch
+  shift <date> <new> - move all entries on date to a new date, keeping times
+  clone-day <date> <new>
+                    - copy all entries on date to a new date, for a day that
+                      repeats; refused if they would overlap sessions there
+  export [N]        - this week's (or N weeks ago) project totals, as a
+                      Markdown table unless -format says otherwise
+  month [N]         - calendar of this month's (or N months ago) daily totals
+  import <file>     - add the sessions in a Toggl CSV export (-from toggl) to
+                      the timelog in time order
+  backup            - copy the timelog to a timestamped file beside it, or in
+                      TT_BACKUP_DIR; -keep n keeps only the newest n
+  contexts [N]      - this week's (or N weeks ago) hours in each -context
+  projects [N]      - tree of all projects used, with hours over the last N days
+  recent [N]        - the last N sessions (default 5), newest first
+  switches [N]      - each switch between projects today (or over the last N
+                      days), with a count
+  schema            - the versioned JSON Schema of each JSON output, such as
+                      -json reports
+  stint             - time worked since the last real break (-stint-gap)
+  agg               - hours per day, week or month as a series (-by, -last)
+  fix-order         - sort the log chronologically (-force if pairing breaks)
+  prune-duplicates  - remove entries repeated exactly (same type, time and project)
+  watch             - live display of the open session's elapsed time
+  init              - create an empty timelog (at -file or -path) and a starter
+                      config, with next steps; -force rewrites the config
+  config            - show the effective settings and where each came from
 Options:
   -group            - group output by project
-  -file <filename>  - specify timelog file
-  [filename]        - specify timelog file as last argument
+  -file <filename>  - specify timelog file; a glob pattern merges several
+                      files for reporting, and an http(s) URL can be read
+                      by reporting commands
+  -force            - write entries even if they would be out of order
+  -depth <n>        - limit grouped output to n levels of the project hierarchy
+  -weekday <day>    - with hours, total each <day> over the last -weeks weeks
+  -per-weekday-avg  - with hours, average each weekday over the last -weeks
+                      weeks; days with no work are left out of the average
+  -weeks <n>        - number of weeks for -weekday and -per-weekday-avg
+                      (default 4)
+  -include-open-as <HH:MM>
+                    - count the open session as if it ends at HH:MM today
+  -as-of <time>     - run a report as if it were that time, such as
+                      "2024-02-10 17:00": later entries are ignored and a
+                      session open then ends there
+  -output <file>    - write the report to a file instead of stdout, creating
+                      its directory if needed; works with -json and -csv.
+                      Errors go to stderr and exit 1
+  -sub              - with in/sw, treat each word as a level of the project,
+                      e.g. "in -sub acme dev" clocks into acme:dev
+  -note <text>      - with in/sw, attach a note to the session
+  -tz-display <zone>
+                    - show times in cat and stint in another zone, such as
+                      America/New_York; totals are unaffected
+  -context <name>   - use a separate timeline, kept in timelog.<name>.txt beside
+                      the timelog, that may overlap sessions in others
+  -map <columns>    - with import, the Toggl columns that make up the project,
+                      joined as levels (default project), e.g. client:project
+  -exclude-open-project <project>
+                    - leave the open session out of today's totals when it is
+                      on this project or under it; its closed sessions count
+  -q                - don't note how much of a total is the open session
+  -full-paths       - in grouped reports, name each line by its full project
+                      path, such as acme:dev:frontend
+  -project-summary-only
+                    - list only the top level projects, most hours first,
+                      and the total
+  -count-sessions   - with grouped reports, show how many sessions make up
+                      each total and their average length
+  -min-session-for-stats <d>
+                    - with -count-sessions, leave sessions shorter than a
+                      duration such as 2m out of the counts and averages;
+                      unlike -min-duration they still add to the hours
+  -combine-adjacent - with -detail and -count-sessions, treat sessions of the
+                      same project less than -combine-gap apart as one;
+                      total hours are unchanged
+  -combine-gap <d>  - the gap for -combine-adjacent (default 5m, or
+                      TT_COMBINE_GAP)
+  -resume-or-close  - with in, offer to close a session open longer than
+                      -stale-after (default 8h, or TT_STALE_AFTER), such as
+                      after a crash, before clocking in
+  -close-at <time>  - close it at this time, or HH:MM that day, without asking
+  -switch-if-open   - let in switch projects when already clocked in
+  -recent <n>       - with in/sw and no project, pick the nth entry of the
+                      recent projects menu without prompting
+  -frequency        - order the in/sw project menu by use over the last 30 days
+  -mru              - order the in/sw project menu most recent first (default)
+  -git-branch       - with in/sw, add the current git branch to the note
+  -group-by note    - group reports by session note instead of project
+  -group-by date    - group reports by day, with each day's projects under it
+  -project-regex <re>
+                    - only count sessions whose project matches a regular
+                      expression, e.g. 'client-\d+'
+  -sum-only-matching-days
+                    - with -project-regex, count all hours, but only on days
+                      with a session on a matching project
+  -min-duration <d> - drop sessions shorter than a duration such as 30s or 5m
+  -v                - verbose; report how many sessions were filtered out
+  -notify <d>       - with watch, draw nothing but send a desktop notification
+                      once a session has run for a duration such as 3h
+  -every <d>        - with -notify, repeat the notification at this interval
+  -stint-gap <d>    - largest break that doesn't end a stint (default 5m)
+  -workdays-only    - with -daily, leave weekend days out of the average
+  -unit <d>         - bill each session in units such as 6m: at least one unit,
+                      then rounded up; grouped totals sum the rounded sessions
+  -rate <amount>    - end reports with what the hours come to at this hourly
+                      rate, by top level project
+  -rate-file <file> - hourly rates by project, as "project = rate" lines such
+                      as "acme = 120"; a project uses its own or its nearest
+                      parent's rate, then -rate. Sessions are billed after
+                      -unit and -round
+  -currency <code>  - write amounts in USD, CAD, AUD, GBP, EUR, CHF or JPY
+                      style, or put any other value before them as a symbol
+                      (default a plain number, or TT_CURRENCY)
+  -round <d>        - round each session to a multiple of a duration such as 15m
+  -round-dir floor|ceil|nearest
+                    - direction -round rounds in (default nearest); -floor and
+                      -ceil are short for the first two
+  -exclude-weekends - leave hours worked on weekend days out of reports
+  -fill-gaps-as <project>
+                    - count the gaps between sessions within the working
+                      window under a project, such as overhead; the log is
+                      unchanged
+  -work-window <HH:MM-HH:MM>
+                    - working hours for -fill-gaps-as (default 09:00-17:00,
+                      or TT_WORK_WINDOW)
+  -day-boundary <HH:MM>
+                    - time a working day starts, so work after midnight counts
+                      towards the day before (default 00:00)
+  -exclude-dates <file>
+                    - leave the dates listed in a file, one per line, such as
+                      holidays, out of totals and daily averages
+  -weekend <days>   - comma separated weekend days (default sat,sun)
+  -by day|week|month
+                    - bucket size for agg (default week)
+  -last <n>         - number of buckets for agg (default 12)
+  -rolling <n>      - with agg, add the average of each bucket and the n-1
+                      before it
+  -daily            - with tw/lw, list the hours for each day of the week
+  -week-start <day> - day weeks start on for tw, lw and agg, e.g. thu for a
+                      Thursday to Wednesday week (default mon, or
+                      TT_WEEK_START)
+  -relative-dates   - with recent and switches, show dates within the past
+                      week as today, yesterday or last Tue; times are kept
+  -absolute-dates   - always show full dates, overriding TT_DATES or dates
+                      in the config
+  -end-of-week <day>
+                    - the same, given the day weeks end on, e.g. wed
+  -goal <hours>     - with tw, draw a progress bar towards a weekly goal, also
+                      set by TT_WEEK_GOAL or week_goal in the config
+  -minutes          - show report totals, grouped or not, in whole minutes
+  -detail           - with td/yd, list each session's start, end and duration
+                      before the total
+  -week-numbers     - with -daily, start each day with its ISO week, e.g. W06
+  -running-total    - with tw/lw, list each day with a cumulative total
+  -cap <project=h>  - flag reports where a project, with its subprojects, is
+                      over h hours; may be repeated
+  -project-aliases <file>
+                    - in reports, count old project names under new ones, read
+                      as "old = new" lines that also rename subprojects; also
+                      TT_PROJECT_ALIASES or project_aliases in the config
+  -normalize-case   - in reports, merge projects whose names differ only in
+                      case under their most common spelling
+  -ignore-case      - with projects, merge names differing only in case and
+                      list their spellings
+  -carryover        - with tw/lw, list each day's hours against -target and
+                      the accumulated flextime balance
+  -target <hours>   - daily target for -carryover, on days that aren't weekend
+  -target-from-file <file>
+                    - targets for particular days, as "date-or-weekday hours"
+                      lines such as "2024-02-09 4" or "fri 6"; a date wins
+                      over its weekday, and days not listed use -target
+  -cache            - keep parsed entries in a file beside the timelog, reused
+                      until it changes, to speed up reports on long logs;
+                      also TT_CACHE=on or cache = on in the config
+  -no-cache         - don't use the cache this run
+  -csv              - print reports as CSV: project,hours when grouped,
+                      date,hours for daily reports
+  -tsv, -format tsv - like -csv but tab separated, for pasting into a
+                      spreadsheet
+  -quantile [q,...] - print session length quantiles instead of totals,
+                      0.25,0.5,0.75,0.9 unless listed, e.g. 0.5,0.9
+  -json             - print reports as JSON with the total, project totals and
+                      entries
+  -json-pretty      - like -json, but indented for reading
+  -format markdown  - render grouped totals as a Markdown table
+  -format <template>
+                    - render reports with a Go text/template. Fields: .Total,
+                      .Projects (project -> hours) and .Entries, each with
+                      .Project, .Segments, .Hours and .Date
+  [filename]        - specify timelog file as last argument; in, out and sw
+                      take every word as the project, so use -file with them
 
 	last, yd, lw, cat can all take a param N to indicate how many days back, e.g. "yd 3" for 3 days ago.
-	they can also be suffixed with ^ characters, e.g. "yd^^" for 2 days ago.`, prog)
+	yd also takes a negative N to look forward, e.g. "yd -1" for tomorrow.
+	they can also be suffixed with ^ characters, e.g. "yd^^" for 2 days ago.
+`, prog)
 
-	fmt.Println("If no -file option is given, the TIMELOG environment variable is used if set, otherwise 'timelog.txt' in the current directory.")
+	fmt.Println("Project names: ':' separates hierarchy levels and words are joined with spaces, so 'in acme:dev' and 'in -sub acme dev' both")
+	fmt.Println("clock into acme:dev, while 'in code review' or 'in \"code review\"' clock into a single project named 'code review'.")
+	fmt.Println("A project named like a command, such as 'out', is refused unless -force is given.")
+	fmt.Println("in, out and sw take an optional leading timestamp in the entry format, with or without seconds, such as")
+	fmt.Println("'in \"2024-02-09 14:00\" acme' to record that time instead of now; it must not be before the last entry.")
+	fmt.Println("A project of @name in in/sw expands the config's 'template.name = project' line; two spaces and text after the project set a default note.")
+	fmt.Println("Projects are written with runs of spaces collapsed and each level trimmed. TT_LOWERCASE (or lowercase in the config),")
+	fmt.Println("a comma separated list of top level projects or all, lowercases those projects as they are written.")
+	fmt.Println("If in/sw are given no project, TT_PROJECT or a .ttproject file in the current directory or a parent (up to the repo root) supplies it.")
+	fmt.Println("If TT_HOOK names an executable it is run after each in, out and sw with the event, project and time as arguments.")
+	fmt.Println("TT_TIMESTAMP_FORMAT (or timestamp_format in the config) sets the Go time layout new entries are written with, or rfc3339;")
+	fmt.Println("entries in it or the default 2006-01-02 15:04:05 are both read.")
+	fmt.Println("If TT_AUDIT names a file, every command that changes the timelog appends the lines it removed and added there.")
+	fmt.Println("A session still left open since an earlier day counts until the end of the day it started, with a warning.")
+	fmt.Println("A session crossing midnight, or the day boundary, counts towards each day it covers, so a range gets only its own part.")
+	fmt.Println("If no -file option is given, the TIMELOG environment variable is used if set, then 'timelog' from the config file, otherwise 'timelog.txt' in the current directory.")
 }
 
 func getTimelogFile() string {
-	if timeLogFile != "" {
-		return timeLogFile
+	name := resolveSetting("timelog", timeLogFile, "TIMELOG", "timelog.txt").Value
+	if contextName != "" {
+		return contextFile(name, contextName)
 	}
+	return name
+}
 
-	return "timelog.txt"
+// contextFile is the timelog for a named context: timelog.txt's build
+// context is kept in timelog.build.txt. Each context is a timeline of its
+// own, so sessions in different contexts may overlap.
+func contextFile(timelog, context string) string {
+	ext := filepath.Ext(timelog)
+	return strings.TrimSuffix(timelog, ext) + "." + context + ext
 }
 
-func handleLast(action string, args []string) {
-	count := 1 + getTrailingCaratCount(action)
-	if len(args) > 0 {
-		fmt.Sscanf(args[0], "%d", &count)
-		count = max(1, count)
+// reportContexts prints the hours in the default timelog and in each
+// context found beside it for the week weeksAgo weeks back.
+func reportContexts(weeksAgo int) error {
+	base := resolveSetting("timelog", timeLogFile, "TIMELOG", "timelog.txt").Value
+	if isURL(base) || strings.ContainsAny(base, "*?[") {
+		return fmt.Errorf("contexts need a single local timelog, not %s", base)
 	}
-	if proj, err := lastProjectN(count); err == nil {
-		fmt.Println("Last closed project:", proj)
-	} else {
-		fmt.Println("Error:", err)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	matches, err := filepath.Glob(stem + ".*" + ext)
+	if err != nil {
+		return err
+	}
+	contexts := []string{""}
+	for _, m := range matches {
+		name := strings.TrimSuffix(strings.TrimPrefix(m, stem+"."), ext)
+		if name != "" && !strings.Contains(name, ".") {
+			contexts = append(contexts, name)
+		}
+	}
+
+	defer func(saved string) { contextName = saved }(contextName)
+	var total float64
+	for _, name := range contexts {
+		contextName = name
+		hours, _, _, _, err := hoursForWeek(weeksAgo, false)
+		if err != nil {
+			if name == "" && errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		if name == "" {
+			name = "(default)"
+		}
+		fmt.Printf("%16s  %s\n", formatHours(hours), name)
+		total += hours
 	}
+	fmt.Println("--------------------")
+	fmt.Printf("%16s\n", formatHours(total))
+	return nil
 }
 
-func handleYd(action string, args []string, group bool) {
-	count := 1 + getTrailingCaratCount(action)
-	if len(args) > 0 {
-		fmt.Sscanf(args[0], "%d", &count)
-		count = max(1, count)
+// timelogPaths expands the timelog path when it is a glob pattern, so
+// reports can span several files. A pattern matching nothing is an error.
+func timelogPaths() ([]string, error) {
+	name := getTimelogFile()
+	if isURL(name) || !strings.ContainsAny(name, "*?[") {
+		return []string{name}, nil
 	}
-	hours, _, _, entries, err := hoursForDay(count, group)
+	matches, err := filepath.Glob(name)
 	if err != nil {
-		fmt.Println("Error:", err)
-	} else if group {
-		DisplayHierTotals(entries)
-	} else {
-		switch count {
-		case 1:
-			fmt.Printf("Hours worked 1 day ago: %.2f\n", hours)
-		default:
-			fmt.Printf("Hours worked %d days ago: %.2f\n", count, hours)
-		}
+		return nil, fmt.Errorf("invalid timelog pattern %s: %w", name, err)
 	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no files match %s", name)
+	}
+	return matches, nil
 }
 
-func handleLw(action string, args []string, group bool) {
-	count := 1 + getTrailingCaratCount(action)
-	if len(args) > 0 {
-		fmt.Sscanf(args[0], "%d", &count)
-		count = max(1, count)
-	}
-	hours, _, _, entries, err := hoursForWeek(count, group)
+// writableTimelog returns the file write commands modify, rejecting a glob
+// that matches more than one file.
+func writableTimelog() (string, error) {
+	paths, err := timelogPaths()
 	if err != nil {
-		fmt.Println("Error:", err)
-	} else if group {
-		DisplayHierTotals(entries)
-	} else {
-		switch count {
-		case 1:
-			fmt.Printf("Hours worked last week: %.2f\n", hours)
-		default:
-			fmt.Printf("Hours worked %d weeks ago: %.2f\n", count, hours)
+		return "", err
+	}
+	if len(paths) > 1 {
+		return "", fmt.Errorf("%s matches %d files; write commands need a single file", getTimelogFile(), len(paths))
+	}
+	if isURL(paths[0]) {
+		return "", fmt.Errorf("%s is a URL; write commands need a local file", paths[0])
+	}
+	if err := checkNotDir(paths[0]); err != nil {
+		return "", err
+	}
+	return paths[0], nil
+}
+
+// checkNotDir turns a timelog path that names a directory into a clear error
+// rather than a confusing failure from scanning or writing it
+func checkNotDir(name string) error {
+	if info, err := os.Stat(name); err == nil && info.IsDir() {
+		return fmt.Errorf("timelog path is a directory: %s", name)
+	}
+	return nil
+}
+
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// fetchedTimelogs holds each timelog fetched over HTTP(S), by URL, so a
+// report reading it many times only fetches it once
+var fetchedTimelogs = make(map[string][]byte)
+
+// openPath opens a local timelog or fetches one over HTTP(S)
+func openPath(name string) (io.ReadCloser, error) {
+	if !isURL(name) {
+		if err := checkNotDir(name); err != nil {
+			return nil, err
 		}
+		return os.Open(name)
+	}
+	if data, ok := fetchedTimelogs[name]; ok {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	client := http.Client{Timeout: httpTimeout}
+	resp, err := client.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("fetching timelog: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching timelog %s: %s", name, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetching timelog %s: %w", name, err)
 	}
+	fetchedTimelogs[name] = data
+	return io.NopCloser(bytes.NewReader(data)), nil
 }
 
-func handleIns(action string, args []string) {
-	count := getTrailingCaratCount(action)
-	if len(args) > 0 {
-		fmt.Sscanf(args[0], "%d", &count)
-		count = max(1, count)
+// openTimelog opens the timelog for reading. When the path is a glob
+// matching several files their lines are merged in timestamp order. With
+// -as-of, entries after that time are left out.
+func openTimelog() (io.ReadCloser, error) {
+	r, err := openTimelogFiles()
+	if err != nil || asOf.IsZero() {
+		return r, err
 	}
-	err := CatInEntries(count)
+	defer r.Close()
+	var lines []string
+	scanner := newScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	var buf strings.Builder
+	for _, kl := range keyLines(lines) {
+		if !kl.t.After(asOf) {
+			buf.WriteString(kl.line + "\n")
+		}
+	}
+	return io.NopCloser(strings.NewReader(buf.String())), nil
+}
+
+// openTimelogFiles reads the file or files making up the timelog
+func openTimelogFiles() (io.ReadCloser, error) {
+	paths, err := timelogPaths()
 	if err != nil {
-		fmt.Println("Error:", err)
+		return nil, err
+	}
+	if len(paths) == 1 {
+		return openPath(paths[0])
+	}
+
+	var merged []keyedLine
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		var lines []string
+		scanner := newScanner(f)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		merged = append(merged, keyLines(lines)...)
+	}
+	slices.SortStableFunc(merged, func(a, b keyedLine) int { return a.t.Compare(b.t) })
+
+	var buf strings.Builder
+	for _, kl := range merged {
+		buf.WriteString(kl.line + "\n")
 	}
+	return io.NopCloser(strings.NewReader(buf.String())), nil
 }
 
-func handleCat(action string, args []string) {
-	count := getTrailingCaratCount(action)
-	if len(args) > 0 {
-		fmt.Sscanf(args[0], "%d", &count)
-		count = max(1, count)
+// keyedLine is a timelog line with the time it sorts by
+type keyedLine struct {
+	t    time.Time
+	line string
+}
+
+// keyLines keys each line by its timestamp. Lines without one, such as
+// comments, take the time of the entry before them so they stay attached to
+// it; any before the first entry sort to the top.
+func keyLines(lines []string) []keyedLine {
+	keyed := make([]keyedLine, 0, len(lines))
+	var last time.Time
+	for _, line := range lines {
+		if t, err := entryTime(line); err == nil {
+			last = t
+		}
+		keyed = append(keyed, keyedLine{last, line})
 	}
-	err := CatAllEntries(count)
+	return keyed
+}
+
+// setting is a resolved configuration value and where it came from
+type setting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+var configValues map[string]string
+
+// configPath returns the config file location: TT_CONFIG if set, otherwise
+// tt/config under the user config directory.
+func configPath() string {
+	if p := os.Getenv("TT_CONFIG"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
 	if err != nil {
-		fmt.Println("Error:", err)
+		return ""
 	}
+	return filepath.Join(dir, "tt", "config")
 }
 
-func validateTimelogFile(filename string) error {
-	f, err := os.Open(filename)
+// loadConfig reads "key = value" lines from the config file, ignoring blank
+// lines and # comments. A missing file is an empty config.
+func loadConfig() map[string]string {
+	if configValues != nil {
+		return configValues
+	}
+	configValues = make(map[string]string)
+	f, err := os.Open(configPath())
 	if err != nil {
-		return err
+		return configValues
 	}
 	defer f.Close()
-
-	var lastTime time.Time
-	scanner := bufio.NewScanner(f)
-	lineNum := 0
+	scanner := newScanner(f)
 	for scanner.Scan() {
-		lineNum++
-		line := scanner.Text()
-		if strings.HasPrefix(line, "i ") || strings.HasPrefix(line, "o ") {
-			parts := strings.Fields(line)
-			if len(parts) < 3 {
-				fmt.Printf("Warning: line %d malformed: %s\n", lineNum, line)
-				continue
-			}
-			datetime := parts[1] + " " + parts[2]
-			t, err := time.ParseInLocation(dateTimeFormat, datetime, time.Local)
-			if err != nil {
-				fmt.Printf("Warning: line %d invalid time: %s\n", lineNum, line)
-				continue
-			}
-			if !lastTime.IsZero() && t.Before(lastTime) {
-				fmt.Printf("Warning: line %d time %s before previous entry (%s)\n", lineNum, t.Format(dateTimeFormat), lastTime.Format(dateTimeFormat))
-			}
-			lastTime = t
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
 		}
+		configValues[strings.TrimSpace(key)] = strings.TrimSpace(value)
 	}
-	return nil
+	return configValues
 }
 
-func clockIn(project string) error {
-	if alreadyCheckedIn() {
-		return errors.New("already checked in")
+// expandTemplate returns the project and note of a template, set in the
+// config as "template.<name> = <project>", optionally followed by two spaces
+// and a default note as in the log.
+func expandTemplate(name string) (string, string, error) {
+	config := loadConfig()
+	value, ok := config["template."+name]
+	if !ok {
+		var known []string
+		for key := range config {
+			if t, ok := strings.CutPrefix(key, "template."); ok {
+				known = append(known, "@"+t)
+			}
+		}
+		if len(known) == 0 {
+			return "", "", fmt.Errorf("unknown template @%s; none are defined in %s", name, configPath())
+		}
+		slices.Sort(known)
+		return "", "", fmt.Errorf("unknown template @%s; known templates: %s", name, strings.Join(known, ", "))
 	}
-	entry := fmt.Sprintf("i %s %s\n", time.Now().Format(dateTimeFormat), project)
-	return appendToFile(entry)
+	project, templateNote := splitProjectNote(value)
+	if project == "" {
+		return "", "", fmt.Errorf("template @%s has no project", name)
+	}
+	return project, templateNote, nil
 }
 
-func clockOut(project string) error {
-	if alreadyCheckedOut() {
-		return errors.New("already checked out")
+// resolveSetting applies the precedence flag > env > config > default
+func resolveSetting(name, flagValue, envName, def string) setting {
+	if flagValue != "" {
+		return setting{name, flagValue, "flag"}
 	}
-	entry := fmt.Sprintf("o %s %s\n", time.Now().Format(dateTimeFormat), project)
-	return appendToFile(entry)
+	if envName != "" {
+		if v := os.Getenv(envName); v != "" {
+			return setting{name, v, "env " + envName}
+		}
+	}
+	if v, ok := loadConfig()[name]; ok && v != "" {
+		return setting{name, v, "config"}
+	}
+	return setting{name, def, "default"}
 }
 
-func switchProject(project string) error {
-	if alreadyCheckedOut() {
-		return errors.New("not checked in")
+// resolvedSettings gathers the effective configuration
+func resolvedSettings() []setting {
+	zone, _ := time.Now().Zone()
+	tz := setting{"timezone", time.Local.String() + " (" + zone + ")", "default"}
+	if os.Getenv("TZ") != "" {
+		tz.Source = "env TZ"
 	}
-	if current, _ := currentProject(); current == project {
-		return errors.New("already checked in to this project")
+	rounding := setting{"rounding", "none", "default"}
+	if roundTo > 0 {
+		rounding = setting{"rounding", roundTo.String() + " " + roundDir, "flag"}
 	}
-	if err := clockOut(""); err != nil {
-		return err
+	return []setting{
+		resolveSetting("timelog", timeLogFile, "TIMELOG", "timelog.txt"),
+		resolveSetting("hook", "", "TT_HOOK", ""),
+		resolveSetting("audit", "", "TT_AUDIT", ""),
+		resolveSetting("backup_dir", "", "TT_BACKUP_DIR", "(beside the timelog)"),
+		tz,
+		resolveSetting("week_start", weekStartFlag, "TT_WEEK_START", "monday"),
+		resolveSetting("dates", datesFlag, "TT_DATES", "absolute"),
+		resolveSetting("weekend", weekendFlag, "TT_WEEKEND", "sat,sun"),
+		resolveSetting("day_boundary", dayBoundaryFlag, "TT_DAY_BOUNDARY", "00:00"),
+		resolveSetting("work_window", workWindowFlag, "TT_WORK_WINDOW", "09:00-17:00"),
+		resolveSetting("week_goal", weekGoalFlag, "TT_WEEK_GOAL", ""),
+		resolveSetting("currency", currencyFlag, "TT_CURRENCY", ""),
+		resolveSetting("project_aliases", aliasesFlag, "TT_PROJECT_ALIASES", ""),
+		resolveSetting("cache", cacheFlag, "TT_CACHE", "off"),
+		resolveSetting("lowercase", "", "TT_LOWERCASE", ""),
+		resolveSetting("stale_after", staleAfterFlag, "TT_STALE_AFTER", "8h"),
+		resolveSetting("combine_gap", combineGapFlag, "TT_COMBINE_GAP", "5m"),
+		resolveSetting("timestamp_format", "", "TT_TIMESTAMP_FORMAT", dateTimeFormat),
+		rounding,
+		{"separator", ":", "default"},
 	}
-	return clockIn(project)
 }
 
-func appendToFile(entry string) error {
-	f, err := os.OpenFile(getTimelogFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
-	if err != nil {
-		return err
+// starterConfig is written by init, with the defaults commented out
+const starterConfig = `# tt config: "key = value" lines; flags and environment variables override these
+timelog = %s
+# week_start = monday
+# dates = absolute
+# weekend = sat,sun
+# day_boundary = 00:00
+# work_window = 09:00-17:00
+# timestamp_format = 2006-01-02 15:04:05
+# backup_dir =
+# week_goal = 40
+# currency = EUR
+# stale_after = 8h
+# combine_gap = 5m
+# lowercase =
+# template.standup = meetings:standup
+`
+
+// initTimelog creates an empty timelog at the resolved path and a starter
+// config naming it. It refuses if either exists, unless -force is given, in
+// which case the config is rewritten but a timelog is never emptied.
+func initTimelog() error {
+	timelog, err := filepath.Abs(getTimelogFile())
+	if err != nil {
+		return err
+	}
+	config := configPath()
+	if config == "" {
+		return errors.New("no config directory found; set TT_CONFIG")
+	}
+	_, timelogErr := os.Stat(timelog)
+	if !force {
+		for _, path := range []string{timelog, config} {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists; use -force to rewrite the config (the timelog is kept)", path)
+			}
+		}
+	}
+	for _, dir := range []string{filepath.Dir(timelog), filepath.Dir(config)} {
+		if err := checkWritableDir(dir); err != nil {
+			return err
+		}
+	}
+	if timelogErr != nil {
+		if err := os.WriteFile(timelog, nil, 0644); err != nil {
+			return err
+		}
+		fmt.Println("Created timelog", timelog)
+	} else {
+		fmt.Println("Kept existing timelog", timelog)
+	}
+	if err := os.WriteFile(config, []byte(fmt.Sprintf(starterConfig, timelog)), 0644); err != nil {
+		return err
+	}
+	fmt.Println("Wrote config", config)
+	fmt.Println()
+	fmt.Println("Next steps:")
+	fmt.Println("  tt in <project>   start a session, e.g. tt in acme:website")
+	fmt.Println("  tt out            end it")
+	fmt.Println("  tt td             see today's hours")
+	fmt.Println("  tt config         check the settings, and edit", config, "to change them")
+	return nil
+}
+
+// checkWritableDir creates dir if needed and checks a file can be written
+// in it
+func checkWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("can't create %s: %w", dir, err)
+	}
+	f, err := os.CreateTemp(dir, ".tt-init*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func printConfig() {
+	path := configPath()
+	if _, err := os.Stat(path); err != nil {
+		path += " (not found)"
+	}
+	fmt.Printf("%-12s %s\n", "config file", path)
+	for _, st := range resolvedSettings() {
+		fmt.Printf("%-12s %-40s [%s]\n", st.Name, st.Value, st.Source)
+	}
+}
+
+func handleLast(action string, args []string) {
+	count := 1 + getTrailingCaratCount(action)
+	if len(args) > 0 {
+		fmt.Sscanf(args[0], "%d", &count)
+		count = max(1, count)
+	}
+	if proj, err := lastProjectN(count); err == nil {
+		fmt.Println("Last closed project:", proj)
+	} else {
+		printError(err)
+	}
+}
+
+func handleYd(action string, args []string, group bool) {
+	count := 1 + getTrailingCaratCount(action)
+	// A negative count looks forward, for planned future entries
+	if len(args) > 0 {
+		fmt.Sscanf(args[0], "%d", &count)
+		if count == 0 {
+			count = 1
+		}
+	}
+	hours, _, _, entries, err := hoursForDay(count, group)
+	if err == nil && detail {
+		err = displayDayDetail(count)
+	}
+	if err == nil {
+		var label string
+		switch {
+		case count == 1:
+			label = "Hours worked 1 day ago"
+		case count == -1:
+			label = "Hours planned 1 day from now"
+		case count < 0:
+			label = fmt.Sprintf("Hours planned %d days from now", -count)
+		default:
+			label = fmt.Sprintf("Hours worked %d days ago", count)
+		}
+		err = printReport(label, hours, entries, group)
+	}
+	if err != nil {
+		printError(err)
+	}
+}
+
+func handleLw(action string, args []string, group bool) {
+	count := 1 + getTrailingCaratCount(action)
+	if len(args) > 0 {
+		fmt.Sscanf(args[0], "%d", &count)
+		count = max(1, count)
+	}
+	if daily || runningTotal || carryover {
+		if err := reportDays(weekRange(count)); err != nil {
+			printError(err)
+		}
+		return
+	}
+	hours, _, _, entries, err := hoursForWeek(count, group)
+	if err == nil {
+		label := fmt.Sprintf("Hours worked %d weeks ago", count)
+		if count == 1 {
+			label = "Hours worked last week"
+		}
+		err = printReport(label, hours, entries, group)
+	}
+	if err != nil {
+		printError(err)
+	}
+}
+
+func handleIns(action string, args []string) {
+	count := getTrailingCaratCount(action)
+	if len(args) > 0 {
+		fmt.Sscanf(args[0], "%d", &count)
+		count = max(1, count)
+	}
+	err := CatInEntries(count)
+	if err != nil {
+		printError(err)
+	}
+}
+
+func handleCat(action string, args []string) {
+	count := getTrailingCaratCount(action)
+	if len(args) > 0 {
+		fmt.Sscanf(args[0], "%d", &count)
+		count = max(1, count)
+	}
+	err := CatAllEntries(count)
+	if err != nil {
+		printError(err)
+	}
+}
+
+// errTooManyIssues stops validate -strict once -max-issues are reported
+var errTooManyIssues = errors.New("too many issues")
+
+func validateTimelogFile(filename string) error {
+	f, err := openPath(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var lastTime time.Time
+	// the most recent close, to catch sessions that start before it
+	var lastOut time.Time
+	var lastOutLine int
+	scanner := newScanner(f)
+	lineNum := 0
+	// warn reports a problem on the current line, returning whether -strict
+	// has reached -max-issues
+	warn := func(format string, a ...any) bool {
+		msg := fmt.Sprintf(format, a...)
+		if !strict {
+			fmt.Printf("Warning: line %d %s\n", lineNum, msg)
+			return false
+		}
+		fmt.Printf("%s:%d: %s\n", filename, lineNum, msg)
+		strictIssues++
+		return maxIssues > 0 && strictIssues >= maxIssues
+	}
+	for scanner.Scan() {
+		lineNum++
+		line := trimLine(scanner.Text())
+		if strings.HasPrefix(line, "i ") || strings.HasPrefix(line, "o ") {
+			parts := strings.Fields(line)
+			if len(parts) < 2 {
+				if warn("malformed: %s", line) {
+					return errTooManyIssues
+				}
+				continue
+			}
+			t, err := entryTime(line)
+			if err != nil {
+				if warn("invalid time: %s", line) {
+					return errTooManyIssues
+				}
+				continue
+			}
+			if !lastTime.IsZero() && t.Before(lastTime) {
+				if warn("time %s before previous entry (%s)", t.Format(dateTimeFormat), lastTime.Format(dateTimeFormat)) {
+					return errTooManyIssues
+				}
+			}
+			if parts[0] == "i" && !lastOut.IsZero() && t.Before(lastOut) {
+				if warn("session starts at %s, overlapping the session closed on line %d (%s)", t.Format(dateTimeFormat), lastOutLine, lastOut.Format(dateTimeFormat)) {
+					return errTooManyIssues
+				}
+			}
+			if parts[0] == "o" {
+				lastOut = t
+				lastOutLine = lineNum
+			}
+			lastTime = t
+		}
+	}
+	return scanner.Err()
+}
+
+func clockIn(project string) error {
+	if in, err := alreadyCheckedIn(); err != nil {
+		return err
+	} else if in {
+		return errors.New("already checked in")
+	}
+	now := clockNow()
+	if err := checkEntryOrder(now); err != nil {
+		return err
+	}
+	sessionNote := note
+	if gitBranch {
+		if branch := currentGitBranch(); branch != "" {
+			sessionNote = strings.TrimSpace(sessionNote + " " + branch)
+		}
+	}
+	entry := fmt.Sprintf("i %s %s\n", now.Format(timestampFormat), project)
+	if sessionNote != "" {
+		entry = fmt.Sprintf("i %s %s  %s\n", now.Format(timestampFormat), project, sessionNote)
+	}
+	last, _ := lastEntry()
+	if err := appendToFile(entry); err != nil {
+		return err
+	}
+
+	fmt.Printf("Clocked in to %s at %s\n", project, now.Format("15:04:05"))
+	// A switch writes its 'o' immediately before, so there is no break to report
+	if lastOut, err := entryTime(last); err == nil && strings.HasPrefix(last, "o ") {
+		if gap := now.Sub(lastOut); gap > switchGap {
+			fmt.Printf("Break since last out: %s\n", formatDuration(gap))
+		}
+	}
+	return nil
+}
+
+// offerStaleClose asks whether to close the open session if it has run
+// longer than stale_after, as after a sleep or crash. It is closed at
+// -close-at, a time given at the prompt, or by default the end of the day
+// it started, and never after now. It reports whether it closed it.
+func offerStaleClose() (bool, error) {
+	value := resolveSetting("stale_after", staleAfterFlag, "TT_STALE_AFTER", "8h").Value
+	staleAfter, err := time.ParseDuration(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid stale_after %q: %w", value, err)
+	}
+	project, start, open, err := openSession()
+	if err != nil || !open || time.Since(start) < staleAfter {
+		return false, err
+	}
+	boundary, err := dayBoundary()
+	if err != nil {
+		return false, err
+	}
+	end := endOfDay(start, boundary)
+	if now := time.Now().Truncate(time.Second); now.Before(end) {
+		end = now
+	}
+	answer := closeAt
+	if answer == "" {
+		fmt.Printf("%s has been open since %s (%s). Close it at %s? [Y/n/time] ", project, start.Format(dateTimeFormat), formatDuration(time.Since(start)), end.Format(dateTimeFormat))
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.TrimSpace(line)
+	}
+	switch strings.ToLower(answer) {
+	case "", "y", "yes":
+	case "n", "no":
+		return false, nil
+	default:
+		t, err := parseTimestampArg(answer)
+		if err != nil {
+			// a time of day is on the day the session started
+			c, cerr := time.ParseInLocation("15:04", answer, time.Local)
+			if cerr != nil {
+				return false, fmt.Errorf("invalid close time %q", answer)
+			}
+			t = time.Date(start.Year(), start.Month(), start.Day(), c.Hour(), c.Minute(), 0, 0, time.Local)
+		}
+		end = t
+	}
+	if !end.After(start) || end.After(time.Now()) {
+		return false, fmt.Errorf("close time %s must be after %s and not in the future", end.Format(dateTimeFormat), start.Format(dateTimeFormat))
+	}
+	if err := appendToFile(fmt.Sprintf("o %s\n", end.Format(timestampFormat))); err != nil {
+		return false, err
+	}
+	fmt.Printf("Closed %s at %s after %s\n", project, end.Format(dateTimeFormat), formatDuration(end.Sub(start)))
+	runHook("out", project)
+	return true, nil
+}
+
+func clockOut(project string) error {
+	if out, err := alreadyCheckedOut(); err != nil {
+		return err
+	} else if out {
+		return errors.New("already checked out")
+	}
+	now := clockNow()
+	if err := checkEntryOrder(now); err != nil {
+		return err
+	}
+	entry := fmt.Sprintf("o %s\n", now.Format(timestampFormat))
+	if project != "" {
+		entry = fmt.Sprintf("o %s %s\n", now.Format(timestampFormat), project)
+	}
+	return appendToFile(entry)
+}
+
+// checkEntryOrder refuses a new entry at t that would precede the last entry
+// in the log, since it would leave the file out of order. With -force it only
+// warns.
+func checkEntryOrder(t time.Time) error {
+	last, err := lastEntry()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	lastTime, err := entryTime(last)
+	if err != nil {
+		return nil
+	}
+	if !t.Truncate(time.Second).Before(lastTime) {
+		return nil
+	}
+	msg := fmt.Sprintf("new entry time %s is before last entry (%s)", t.Format(dateTimeFormat), lastTime.Format(dateTimeFormat))
+	if force {
+		fmt.Println("Warning:", msg)
+		return nil
+	}
+	return errors.New(msg + "; use -force to write it anyway")
+}
+
+// entryTime parses the timestamp of an i/o line
+func entryTime(line string) (time.Time, error) {
+	t, _, err := parseEntryLine(line)
+	return t, err
+}
+
+// parseEntryLine splits an entry into its timestamp and whatever follows it,
+// untrimmed. The timestamp may be in timestampFormat or the default
+// dateTimeFormat, and take as many fields as the layout has.
+func parseEntryLine(line string) (time.Time, string, error) {
+	layouts := []string{timestampFormat}
+	if timestampFormat != dateTimeFormat {
+		layouts = append(layouts, dateTimeFormat)
+	}
+	for _, layout := range layouts {
+		// skip the type, then take the layout's fields
+		n := len(strings.Fields(layout))
+		rest := line
+		var stamp []string
+		for range n + 1 {
+			rest = strings.TrimLeft(rest, " \t")
+			end := strings.IndexAny(rest, " \t")
+			if end < 0 {
+				end = len(rest)
+			}
+			stamp = append(stamp, rest[:end])
+			rest = rest[end:]
+		}
+		if stamp[len(stamp)-1] == "" {
+			continue
+		}
+		t, err := time.ParseInLocation(layout, strings.Join(stamp[1:], " "), time.Local)
+		if err == nil {
+			return t.Local(), rest, nil
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("malformed entry: %q", line)
+}
+
+// parseTimestampArg parses a timestamp given on the command line in the
+// configured format, or in it without the seconds
+func parseTimestampArg(s string) (time.Time, error) {
+	t, err := time.ParseInLocation(timestampFormat, s, time.Local)
+	if err != nil {
+		if short, ok := strings.CutSuffix(timestampFormat, ":05"); ok {
+			t, err = time.ParseInLocation(short, s, time.Local)
+		}
+	}
+	return t, err
+}
+
+// clockNow is the time a clock command records: now, unless a timestamp
+// was given
+func clockNow() time.Time {
+	if !entryAt.IsZero() {
+		return entryAt
+	}
+	return time.Now()
+}
+
+// reportNow is the time reports are run at: now, unless -as-of was given
+func reportNow() time.Time {
+	if !asOf.IsZero() {
+		return asOf
+	}
+	return time.Now()
+}
+
+// resolveTimestampFormat returns the layout from TT_TIMESTAMP_FORMAT or the
+// timestamp_format setting. "rfc3339" is accepted as a name for that format.
+func resolveTimestampFormat() string {
+	format := resolveSetting("timestamp_format", "", "TT_TIMESTAMP_FORMAT", dateTimeFormat).Value
+	if strings.EqualFold(format, "rfc3339") {
+		return time.RFC3339
+	}
+	return format
+}
+
+func switchProject(project string) error {
+	if out, err := alreadyCheckedOut(); err != nil {
+		return err
+	} else if out {
+		return errors.New("not checked in")
+	}
+	if current, _ := currentProject(); current == project {
+		return errors.New("already checked in to this project")
+	}
+	if err := clockOut(""); err != nil {
+		return err
+	}
+	return clockIn(project)
+}
+
+// undoLast reverts the effect of the last clock command. A trailing 'i' that
+// immediately follows an 'o' of an open session was written by a switch, so
+// both lines are removed and the previous session is reopened.
+func undoLast() error {
+	lines, err := readTimelogLines()
+	if err != nil {
+		return err
+	}
+	var entries []int
+	for i, line := range lines {
+		if strings.HasPrefix(line, "i ") || strings.HasPrefix(line, "o ") {
+			entries = append(entries, i)
+		}
+	}
+	if len(entries) == 0 {
+		return errors.New("nothing to undo")
+	}
+
+	remove := entries[len(entries)-1:]
+	if n := len(entries); n >= 3 && strings.HasPrefix(lines[entries[n-1]], "i ") &&
+		strings.HasPrefix(lines[entries[n-2]], "o ") && strings.HasPrefix(lines[entries[n-3]], "i ") {
+		inTime, err1 := entryTime(lines[entries[n-1]])
+		outTime, err2 := entryTime(lines[entries[n-2]])
+		if err1 == nil && err2 == nil && inTime.Sub(outTime) <= switchGap {
+			remove = entries[n-2:]
+		}
+	}
+
+	var kept []string
+	for i, line := range lines {
+		if slices.Contains(remove, i) {
+			fmt.Println("Reverted:", trimLine(line))
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if err := writeTimelogLines(kept); err != nil {
+		return err
+	}
+
+	if proj, err := currentProject(); err == nil && proj != "" {
+		fmt.Println("Now clocked in to:", proj)
+	} else {
+		fmt.Println("Now clocked out")
+	}
+	return nil
+}
+
+// session is an in/out pair read from the log. An open session has no Out.
+type session struct {
+	Project string
+	Note    string
+	In      time.Time
+	Out     time.Time
+	Open    bool
+}
+
+// readSessions pairs each 'i' line with the 'o' that follows it
+func readSessions(lines []string) []session {
+	var sessions []session
+	var cur *session
+	for _, line := range lines {
+		t, err := entryTime(line)
+		if err != nil {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "i "):
+			project, note := entryProject(line)
+			cur = &session{Project: project, Note: note, In: t, Open: true}
+		case strings.HasPrefix(line, "o ") && cur != nil:
+			cur.Out = t
+			cur.Open = false
+			sessions = append(sessions, *cur)
+			cur = nil
+		}
+	}
+	if cur != nil {
+		sessions = append(sessions, *cur)
+	}
+	return sessions
+}
+
+// loadSessions reads the sessions from the timelog used for reporting
+func loadSessions() ([]session, error) {
+	f, err := openTimelog()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := newScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, trimLine(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return readSessions(lines), nil
+}
+
+// end returns when the session finished, or now if it is still open
+func (s session) end() time.Time {
+	if s.Open {
+		return reportNow()
+	}
+	return s.Out
+}
+
+// reportStint sums the latest run of back-to-back sessions, where each
+// starts within gap of the previous one ending.
+func reportStint(gap time.Duration) error {
+	sessions, err := loadSessions()
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		return errors.New("no sessions found")
+	}
+	last := len(sessions) - 1
+	first := last
+	for first > 0 && sessions[first].In.Sub(sessions[first-1].end()) <= gap {
+		first--
+	}
+	var total time.Duration
+	for _, s := range sessions[first:] {
+		total += s.end().Sub(s.In)
+	}
+	state := "ended " + displayTime(sessions[last].Out).Format(dateTimeFormat)
+	if sessions[last].Open {
+		state = "ongoing"
+	}
+	fmt.Printf("Stint: %s across %d sessions, began %s (%s)\n", formatDuration(total), last-first+1, displayTime(sessions[first].In).Format(dateTimeFormat), state)
+	return nil
+}
+
+// reportSwitches lists each switch over the last days days, today
+// included: a session ending within switchGap of the next starting on
+// another project.
+func reportSwitches(days int) error {
+	sessions, err := loadSessions()
+	if err != nil {
+		return err
+	}
+	boundary, err := dayBoundary()
+	if err != nil {
+		return err
+	}
+	from := logicalDate(reportNow().AddDate(0, 0, -(days-1)), boundary)
+	var lines []string
+	for i := 1; i < len(sessions); i++ {
+		prev, next := sessions[i-1], sessions[i]
+		if prev.Open || next.In.Sub(prev.Out) > switchGap || next.Project == prev.Project {
+			continue
+		}
+		if logicalDate(next.In, boundary) < from {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%-10s %s  %s -> %s", displayDate(next.In), displayTime(next.In).Format("15:04:05"), prev.Project, next.Project))
+	}
+	if len(lines) == 1 {
+		fmt.Println("1 switch")
+	} else {
+		fmt.Printf("%d switches\n", len(lines))
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// overlaps reports whether two sessions share any time. An open session
+// runs on indefinitely.
+func (s session) overlaps(o session) bool {
+	return (o.Open || s.In.Before(o.Out)) && (s.Open || o.In.Before(s.Out))
+}
+
+// insertEntries adds a block of entry lines to lines, keeping the block's
+// own order and placing it after the last existing entry that is not later
+// than its first entry. A block should be one session; one spanning others
+// would leave the log out of order.
+func insertEntries(lines, block []string) []string {
+	if len(block) == 0 {
+		return lines
+	}
+	pos := len(lines)
+	if t, err := entryTime(block[0]); err == nil {
+		pos = 0
+		for i, line := range lines {
+			if lt, err := entryTime(line); err == nil && !lt.After(t) {
+				pos = i + 1
+			}
+		}
+	}
+	return slices.Insert(slices.Clone(lines), pos, block...)
+}
+
+// importToggl adds the time entries of a Toggl CSV export to the timelog as
+// in/out pairs, each placed in time order. The project is built from the
+// columns named in fields, joined as hierarchy levels, so "client:project"
+// files Toggl's client and project as client:project. The description
+// becomes the note. Rows that can't be read are skipped with a warning.
+func importToggl(path, fields string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	column := make(map[string]int)
+	for i, name := range header {
+		column[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	levels := strings.Split(strings.ToLower(fields), ":")
+	for _, name := range append([]string{"start date", "start time", "end date", "end time"}, levels...) {
+		if _, ok := column[name]; !ok {
+			return fmt.Errorf("%s has no %q column", path, name)
+		}
+	}
+	field := func(record []string, name string) string {
+		i, ok := column[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	lines, err := readTimelogLines()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	imported, skipped := 0, 0
+	for row := 2; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Printf("Warning: row %d: %v\n", row, err)
+			skipped++
+			continue
+		}
+		start, err1 := time.ParseInLocation(dateTimeFormat, field(record, "start date")+" "+field(record, "start time"), time.Local)
+		end, err2 := time.ParseInLocation(dateTimeFormat, field(record, "end date")+" "+field(record, "end time"), time.Local)
+		if err := errors.Join(err1, err2); err != nil || !end.After(start) {
+			fmt.Printf("Warning: row %d: invalid start or end time, skipped\n", row)
+			skipped++
+			continue
+		}
+		var segments []string
+		for _, name := range levels {
+			segments = append(segments, projectSegments(field(record, name))...)
+		}
+		if len(segments) == 0 {
+			fmt.Printf("Warning: row %d: no project, skipped\n", row)
+			skipped++
+			continue
+		}
+		in := fmt.Sprintf("i %s %s", start.Format(timestampFormat), strings.Join(segments, ":"))
+		if description := field(record, "description"); description != "" {
+			in += "  " + description
+		}
+		lines = insertEntries(lines, []string{in, "o " + end.Format(timestampFormat)})
+		imported++
+	}
+	if imported == 0 {
+		return fmt.Errorf("nothing imported from %s", path)
+	}
+	if err := writeTimelogLines(lines); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d sessions from %s", imported, path)
+	if skipped > 0 {
+		fmt.Printf(", skipped %d rows", skipped)
+	}
+	fmt.Println()
+	filename, _ := writableTimelog()
+	return validateTimelogFile(filename)
+}
+
+// shiftDay moves every entry dated from to the date to, preserving times,
+// or with keep copies them there and leaves the originals. It refuses when
+// the day's sessions cross midnight or would overlap with sessions already
+// on the target date.
+func shiftDay(from, to string, keep bool) error {
+	for _, d := range []string{from, to} {
+		if _, err := time.Parse(dateFormat, d); err != nil {
+			return fmt.Errorf("invalid date %q, expected %s", d, dateFormat)
+		}
+	}
+	lines, err := readTimelogLines()
+	if err != nil {
+		return err
+	}
+	var moved, rest []string
+	target, _ := time.ParseInLocation(dateFormat, to, time.Local)
+	for _, line := range lines {
+		t, tail, err := parseEntryLine(line)
+		if err == nil && (strings.HasPrefix(line, "i ") || strings.HasPrefix(line, "o ")) && t.Format(dateFormat) == from {
+			t = time.Date(target.Year(), target.Month(), target.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+			moved = append(moved, line[:2]+t.Format(timestampFormat)+tail)
+			if !keep {
+				continue
+			}
+		}
+		rest = append(rest, line)
+	}
+	if len(moved) == 0 {
+		return fmt.Errorf("no entries on %s", from)
+	}
+	if !strings.HasPrefix(moved[0], "i ") || !strings.HasPrefix(moved[len(moved)-1], "o ") {
+		return fmt.Errorf("entries on %s do not form complete sessions; a session crosses midnight or is still open", from)
+	}
+	for _, ms := range readSessions(moved) {
+		for _, es := range readSessions(rest) {
+			if ms.overlaps(es) {
+				end := "(open)"
+				if !es.Open {
+					end = es.Out.Format("15:04:05")
+				}
+				return fmt.Errorf("session %s-%s %s would overlap %s-%s %s",
+					ms.In.Format(dateTimeFormat), ms.Out.Format("15:04:05"), ms.Project,
+					es.In.Format(dateTimeFormat), end, es.Project)
+			}
+		}
+	}
+	// Place each session on its own, so ones either side of an existing
+	// session on the target date end up around it
+	result := rest
+	for start := 0; start < len(moved); {
+		end := start + 1
+		for end < len(moved) && !strings.HasPrefix(moved[end], "i ") {
+			end++
+		}
+		result = insertEntries(result, moved[start:end])
+		start = end
+	}
+	if err := pairingError(result); err != nil {
+		return fmt.Errorf("%w; the log was not changed", err)
+	}
+	if err := orderError(result); err != nil {
+		return fmt.Errorf("%w; the log was not changed", err)
+	}
+	if err := writeTimelogLines(result); err != nil {
+		return err
+	}
+	verb := "Shifted"
+	if keep {
+		verb = "Copied"
+	}
+	fmt.Printf("%s %d entries from %s to %s\n", verb, len(moved), from, to)
+	filename, _ := writableTimelog()
+	return validateTimelogFile(filename)
+}
+
+// fixOrder stably sorts the log by timestamp and rewrites it. If the sorted
+// entries no longer alternate in/out, some session's out would land before
+// its in, so it refuses unless -force is given.
+func fixOrder() error {
+	lines, err := readTimelogLines()
+	if err != nil {
+		return err
+	}
+	keyed := keyLines(lines)
+	slices.SortStableFunc(keyed, func(a, b keyedLine) int { return a.t.Compare(b.t) })
+	sorted := make([]string, len(keyed))
+	moved := 0
+	for i, kl := range keyed {
+		sorted[i] = kl.line
+		if kl.line != lines[i] {
+			moved++
+		}
+	}
+	if moved == 0 {
+		fmt.Println("Log is already in order")
+		return nil
+	}
+
+	if err := pairingError(sorted); err != nil {
+		if !force {
+			return fmt.Errorf("after sorting, %w; use -force to sort anyway", err)
+		}
+		fmt.Println("Warning: after sorting,", err)
+	}
+
+	if err := writeTimelogLines(sorted); err != nil {
+		return err
+	}
+	fmt.Printf("Sorted log; %d lines changed position\n", moved)
+	filename, _ := writableTimelog()
+	return validateTimelogFile(filename)
+}
+
+// backupTimelog copies the timelog to a timestamped file, such as
+// timelog.txt.bak.2024-02-10T15-04-05, in the backup_dir setting or beside
+// it, and returns its path. With -keep n only the newest n backups are kept.
+func backupTimelog() (string, error) {
+	filename, err := writableTimelog()
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	dir := resolveSetting("backup_dir", "", "TT_BACKUP_DIR", filepath.Dir(filename)).Value
+	prefix := filepath.Join(dir, filepath.Base(filename)+".bak.")
+	path := prefix + time.Now().Format("2006-01-02T15-04-05")
+
+	// write under a temporary name so a partial copy is never mistaken
+	// for a backup
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filename)+".bak*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	// Link rather than rename, as a link never replaces an existing file: a
+	// second backup in the same second gets a numbered name instead of
+	// overwriting the first
+	base := path
+	for n := 1; ; n++ {
+		err := os.Link(tmp.Name(), path)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		path = fmt.Sprintf("%s-%d", base, n)
+	}
+
+	if keepBackups > 0 {
+		// the timestamps sort oldest first
+		backups, err := filepath.Glob(prefix + "*")
+		if err != nil {
+			return path, err
+		}
+		slices.Sort(backups)
+		for _, old := range backups[:max(0, len(backups)-keepBackups)] {
+			if err := os.Remove(old); err != nil {
+				return path, err
+			}
+		}
+	}
+	return path, nil
+}
+
+// pairingError reports the first place lines stop alternating between in
+// and out
+func pairingError(lines []string) error {
+	open := false
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "i ") && open:
+			return fmt.Errorf("line %d starts a session while another is still open: %s", i+1, trimLine(line))
+		case strings.HasPrefix(line, "o ") && !open:
+			return fmt.Errorf("line %d closes a session that isn't open: %s", i+1, trimLine(line))
+		}
+		if strings.HasPrefix(line, "i ") || strings.HasPrefix(line, "o ") {
+			open = strings.HasPrefix(line, "i ")
+		}
+	}
+	return nil
+}
+
+// orderError reports the first entry in lines earlier than the one before it
+func orderError(lines []string) error {
+	var last time.Time
+	for i, line := range lines {
+		t, err := entryTime(line)
+		if err != nil {
+			continue
+		}
+		if t.Before(last) {
+			return fmt.Errorf("line %d is before the entry preceding it: %s", i+1, trimLine(line))
+		}
+		last = t
+	}
+	return nil
+}
+
+// fixTimelog makes the repairs validate can do safely: surrounding
+// whitespace and CR endings are trimmed, blank lines dropped and entries at
+// most fixSortMargin out of order re-sorted. The original is backed up
+// first. Riskier problems, such as overlaps and unclosed sessions,
+// are left for validate to report.
+func fixTimelog() error {
+	filename, err := writableTimelog()
+	if err != nil {
+		return err
+	}
+	lines, err := readTimelogLines()
+	if err != nil {
+		return err
+	}
+	var fixed []string
+	for _, line := range lines {
+		if line = trimLine(line); line != "" {
+			fixed = append(fixed, line)
+		}
+	}
+
+	keyed := keyLines(fixed)
+	var latest time.Time
+	var worst time.Duration
+	for _, kl := range keyed {
+		worst = max(worst, latest.Sub(kl.t))
+		if kl.t.After(latest) {
+			latest = kl.t
+		}
+	}
+	if worst > 0 {
+		slices.SortStableFunc(keyed, func(a, b keyedLine) int { return a.t.Compare(b.t) })
+		sorted := make([]string, len(keyed))
+		for i, kl := range keyed {
+			sorted[i] = kl.line
+		}
+		switch err := pairingError(sorted); {
+		case worst > fixSortMargin:
+			fmt.Printf("Not re-sorting: an entry is %s out of order, more than %s; see fix-order\n", formatDuration(worst), fixSortMargin)
+		case err != nil:
+			fmt.Println("Not re-sorting: after sorting,", err)
+		default:
+			fixed = sorted
+			fmt.Println("Re-sorted entries up to", formatDuration(worst), "out of order")
+		}
+	}
+
+	original, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	// the scanner already dropped any CRs, so look for them in the file
+	crlf := bytes.Contains(original, []byte("\r"))
+	if slices.Equal(lines, fixed) && !crlf {
+		fmt.Println("Nothing to fix")
+		return validateTimelogFile(filename)
+	}
+	if crlf {
+		fmt.Println("Converted CRLF line endings")
+	}
+	backup, err := backupTimelog()
+	if err != nil {
+		return fmt.Errorf("backup failed, nothing changed: %w", err)
+	}
+	if err := writeTimelogLines(fixed); err != nil {
+		return err
+	}
+	for _, line := range diffLines(lines, fixed) {
+		fmt.Println(line)
+	}
+	fmt.Printf("Fixed %s; the original is in %s\n", filename, backup)
+	return validateTimelogFile(filename)
+}
+
+// pruneDuplicates removes repeats of an i/o line, keeping the first, so a
+// botched merge doesn't double-count hours. Entries that differ in any way,
+// including their time, are left alone. Two sessions can close in the same
+// second with identical o lines, so it refuses unless the repeats make up
+// whole sessions, leaving ins and outs still alternating.
+func pruneDuplicates() error {
+	lines, err := readTimelogLines()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	var kept []string
+	removed, removedIns := 0, 0
+	for _, line := range lines {
+		key := trimLine(line)
+		if strings.HasPrefix(key, "i ") || strings.HasPrefix(key, "o ") {
+			if seen[key] {
+				removed++
+				if strings.HasPrefix(key, "i ") {
+					removedIns++
+				}
+				continue
+			}
+			seen[key] = true
+		}
+		kept = append(kept, line)
+	}
+	if removed == 0 {
+		fmt.Println("No duplicate entries found")
+		return nil
+	}
+	if removedIns*2 != removed {
+		return fmt.Errorf("not removing %d repeated entries: they are not whole sessions, so some may be separate sessions ending in the same second", removed)
+	}
+	if err := pairingError(kept); err != nil {
+		return fmt.Errorf("not removing %d repeated entries: without them %w", removed, err)
+	}
+	if err := writeTimelogLines(kept); err != nil {
+		return err
+	}
+	fmt.Printf("Removed %d duplicate entries\n", removed)
+	return nil
+}
+
+// readTimelogLines reads the raw lines of the file that write commands modify
+func readTimelogLines() ([]string, error) {
+	filename, err := writableTimelog()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := newScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// writeTimelogLines replaces the timelog with lines, writing to a temporary
+// file in the same directory first so a failure never leaves it truncated.
+func writeTimelogLines(lines []string) error {
+	filename, err := writableTimelog()
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, line := range lines {
+		w.WriteString(line + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	before, _ := readTimelogLines()
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	recordAudit(before, lines)
+	return nil
+}
+
+// recordAudit appends what a command changed in the timelog to the TT_AUDIT
+// file, if one is configured: the time and command line, then each removed
+// line prefixed with '-' and each added line with '+'. It is best effort, so
+// a failure only warns.
+func recordAudit(before, after []string) {
+	path := resolveSetting("audit", "", "TT_AUDIT", "").Value
+	if path == "" {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", time.Now().Format(dateTimeFormat), strings.Join(os.Args[1:], " "))
+	for _, line := range diffLines(before, after) {
+		b.WriteString(line + "\n")
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err == nil {
+		_, err = f.WriteString(b.String())
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: audit log %s not written: %v\n", path, err)
+	}
+}
+
+// diffLines lists the lines removed from before, prefixed with '-', and
+// those added in after, prefixed with '+'. If the same lines were only
+// moved, it says so instead.
+func diffLines(before, after []string) []string {
+	remaining := make(map[string]int)
+	for _, line := range after {
+		remaining[line]++
+	}
+	var diff []string
+	for _, line := range before {
+		if remaining[line] > 0 {
+			remaining[line]--
+			continue
+		}
+		diff = append(diff, "- "+line)
+	}
+	// Whatever wasn't matched against an old line is new
+	for _, line := range after {
+		if remaining[line] > 0 {
+			remaining[line]--
+			diff = append(diff, "+ "+line)
+		}
+	}
+	if len(diff) == 0 && !slices.Equal(before, after) {
+		diff = append(diff, "  (lines reordered)")
+	}
+	return diff
+}
+
+// runHook invokes the TT_HOOK executable, if configured, after a successful
+// clock event. It receives the event, project and timestamp both as
+// arguments and as TT_EVENT, TT_PROJECT and TT_TIME. Failures only warn.
+func runHook(event, project string) {
+	hook := resolveSetting("hook", "", "TT_HOOK", "").Value
+	if hook == "" {
+		return
+	}
+	stamp := time.Now().Format(dateTimeFormat)
+	if last, err := lastEntry(); err == nil {
+		if t, err := entryTime(last); err == nil {
+			stamp = t.Format(dateTimeFormat)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hook, event, project, stamp)
+	cmd.Env = append(os.Environ(), "TT_EVENT="+event, "TT_PROJECT="+project, "TT_TIME="+stamp)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out after %s", hookTimeout)
+		}
+		fmt.Printf("Warning: hook %s failed: %v\n", hook, err)
+	}
+}
+
+// currentGitBranch returns the branch checked out in the current directory,
+// or "" outside a repository, on a detached HEAD or if git can't be run.
+func currentGitBranch() string {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "git", "rev-parse", "--abbrev-ref", "HEAD").Output()
+	if err != nil {
+		if verbose {
+			fmt.Fprintln(os.Stderr, "No git branch:", err)
+		}
+		return ""
+	}
+	branch := strings.TrimSpace(string(out))
+	if branch == "HEAD" {
+		return ""
+	}
+	return branch
+}
+
+func appendToFile(entry string) error {
+	filename, err := writableTimelog()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(entry); err != nil {
+		return err
+	}
+	recordAudit(nil, []string{strings.TrimSuffix(entry, "\n")})
+	return nil
+}
+
+// alreadyCheckedIn reports whether the last entry is an 'i'. A missing log
+// is neither checked in nor out.
+func alreadyCheckedIn() (bool, error) {
+	last, err := lastEntry()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return strings.HasPrefix(last, "i"), nil
+}
+
+// alreadyCheckedOut reports whether the last entry is an 'o'
+func alreadyCheckedOut() (bool, error) {
+	last, err := lastEntry()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return strings.HasPrefix(last, "o"), nil
+}
+
+func lastEntry() (string, error) {
+	f, err := openTimelog()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var last string
+	scanner := newScanner(f)
+	for scanner.Scan() {
+		if line := trimLine(scanner.Text()); line != "" {
+			last = line
+		}
+	}
+	return last, scanner.Err()
+}
+
+func currentProject() (string, error) {
+	f, err := openTimelog()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var lastIn string
+	var lastType string
+	scanner := newScanner(f)
+	for scanner.Scan() {
+		line := trimLine(scanner.Text())
+		if strings.HasPrefix(line, "i ") {
+			lastIn, _ = entryProject(line)
+			lastType = "i"
+		} else if strings.HasPrefix(line, "o ") {
+			lastType = "o"
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if lastType != "i" || lastIn == "" {
+		return "", nil
+	}
+	return lastIn, nil
+}
+
+// openSession returns the project and start time of the open session, if the
+// last entry is an 'i'.
+func openSession() (string, time.Time, bool, error) {
+	f, err := openTimelog()
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	defer f.Close()
+	var lastIn string
+	var lastType string
+	scanner := newScanner(f)
+	for scanner.Scan() {
+		line := trimLine(scanner.Text())
+		if strings.HasPrefix(line, "i ") {
+			lastIn = line
+			lastType = "i"
+		} else if strings.HasPrefix(line, "o ") {
+			lastType = "o"
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", time.Time{}, false, err
+	}
+	if lastType != "i" {
+		return "", time.Time{}, false, nil
+	}
+	start, err := entryTime(lastIn)
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	project, _ := entryProject(lastIn)
+	return project, start, true, nil
+}
+
+// watchSession redraws the open project and its elapsed time every second
+// until interrupted, picking up clock changes made from other terminals.
+// With -notify it draws nothing and instead sends a desktop notification
+// once a session has run that long, repeated with -every.
+func watchSession() error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	if notifyAfter > 0 {
+		var notified, lastNotice time.Time
+		for {
+			project, start, open, err := openSession()
+			if err == nil && open && time.Since(start) >= notifyAfter {
+				// notified holds the start of the session last notified about
+				if !notified.Equal(start) || (notifyEvery > 0 && time.Since(lastNotice) >= notifyEvery) {
+					sendNotification(fmt.Sprintf("%s has been running for %s", project, formatDuration(time.Since(start))))
+					notified, lastNotice = start, time.Now()
+				}
+			}
+			select {
+			case <-sig:
+				return nil
+			case <-ticker.C:
+			}
+		}
+	}
+
+	fmt.Print("\033[?25l")       // hide cursor
+	defer fmt.Print("\033[?25h") // restore cursor
+	for {
+		project, start, open, err := openSession()
+		fmt.Print("\033[H\033[2J")
+		switch {
+		case err != nil:
+			fmt.Println("Error:", err)
+		case !open:
+			fmt.Println("Clocked out")
+		default:
+			fmt.Println(project)
+			fmt.Println(formatDuration(time.Since(start)))
+		}
+		select {
+		case <-sig:
+			fmt.Println()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendNotification shows a desktop notification with osascript on macOS or
+// notify-send elsewhere. Without a notifier it does nothing.
+func sendNotification(message string) {
+	var cmd *exec.Cmd
+	switch {
+	case runtime.GOOS == "darwin":
+		cmd = exec.Command("osascript", "-e", fmt.Sprintf("display notification %q with title \"tt\"", message))
+	default:
+		path, err := exec.LookPath("notify-send")
+		if err != nil {
+			return
+		}
+		cmd = exec.Command(path, "tt", message)
+	}
+	cmd.Run()
+}
+
+// showRecent lists the last n sessions, newest first, with how long ago
+// each started and how long it ran or, if still open, has run so far
+func showRecent(n int) error {
+	sessions, err := loadSessions()
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		return errors.New("no sessions found")
+	}
+	sessions = sessions[max(0, len(sessions)-n):]
+	slices.Reverse(sessions)
+	for _, s := range sessions {
+		state := ""
+		if s.Open {
+			state = "  (open)"
+		}
+		fmt.Printf("%-10s %s %9s %10s  %s%s\n", displayDate(s.In), displayTime(s.In).Format("15:04"), timeAgo(s.In), formatDuration(s.end().Sub(s.In)), s.Project, state)
+	}
+	return nil
+}
+
+// timeAgo describes how long before now t was, such as "5m ago" or "2h ago"
+func timeAgo(t time.Time) string {
+	switch d := reportNow().Sub(t); {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d/time.Minute))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d/time.Hour))
+	default:
+		return fmt.Sprintf("%dd ago", int(d/(24*time.Hour)))
+	}
+}
+
+// formatDuration renders d as h:mm:ss
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := d / time.Hour
+	d -= h * time.Hour
+	m := d / time.Minute
+	d -= m * time.Minute
+	return fmt.Sprintf("%d:%02d:%02d", h, m, d/time.Second)
+}
+
+func editTimelog() error {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi" // fallback if $EDITOR is not set
+	}
+	filename, err := writableTimelog()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(editor, filename)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func lastProjectN(count int) (string, error) {
+	f, err := openTimelog()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := newScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, trimLine(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	// Find all "o" entry indices (closed projects)
+	var outIndices []int
+	for i, line := range lines {
+		if strings.HasPrefix(line, "o ") {
+			outIndices = append(outIndices, i)
+		}
+	}
+
+	if len(outIndices) < count || count < 1 {
+		return "", errors.New("not enough closed projects")
+	}
+
+	// Get the nth last "o" entry
+	outIdx := outIndices[len(outIndices)-count]
+
+	// Find the most recent valid "i" entry before this "o", skipping any
+	// that are malformed or have no project
+	var lastIn string
+	for i := outIdx - 1; i >= 0; i-- {
+		if !strings.HasPrefix(lines[i], "i ") {
+			continue
+		}
+		if _, err := entryTime(lines[i]); err != nil {
+			continue
+		}
+		if lastIn, _ = entryProject(lines[i]); lastIn != "" {
+			break
+		}
+	}
+
+	if lastIn == "" {
+		return "", errors.New("no closed project found for given count")
+	}
+	return lastIn, nil
+}
+
+// joinProjectArgs builds a project from the in/sw arguments. Separate words
+// form one spaced name ("tt in code review" is "code review"); with -sub each
+// argument is a level of the hierarchy ("tt in -sub acme dev" is acme:dev).
+func joinProjectArgs(args []string) string {
+	if subProject {
+		return strings.Join(projectSegments(strings.Join(args, ":")), ":")
+	}
+	return strings.Join(args, " ")
+}
+
+// normalizeProject tidies a project before it is written: runs of spaces
+// become one and each level is trimmed, so "  a   b : c " is "a b:c" and
+// can't be mistaken for a project and note. Projects under a top level
+// listed in the lowercase setting, or all with "all", are lowercased.
+func normalizeProject(project string) string {
+	segments := strings.Split(project, ":")
+	for i, seg := range segments {
+		segments[i] = strings.Join(strings.Fields(seg), " ")
+	}
+	project = strings.Join(segments, ":")
+	for name := range strings.SplitSeq(resolveSetting("lowercase", "", "TT_LOWERCASE", "").Value, ",") {
+		if name = strings.TrimSpace(name); name == "all" || (name != "" && strings.EqualFold(name, segments[0])) {
+			return strings.ToLower(project)
+		}
+	}
+	return project
+}
+
+// defaultProject is the project used by in/sw when none is given: TT_PROJECT
+// if set, otherwise the first line of a .ttproject file found by walking up
+// from the current directory, stopping at a .git directory or the root.
+func defaultProject() string {
+	if p := os.Getenv("TT_PROJECT"); p != "" {
+		return strings.TrimSpace(p)
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		if data, err := os.ReadFile(filepath.Join(dir, ".ttproject")); err == nil {
+			for line := range strings.Lines(string(data)) {
+				if line = strings.TrimSpace(line); line != "" {
+					return line
+				}
+			}
+		}
+		if info, err := os.Stat(filepath.Join(dir, ".git")); err == nil && info.IsDir() {
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// projectUsage is how often a project was clocked into within usageWindow
+// and when it was last used
+type projectUsage struct {
+	Project  string
+	Count    int
+	LastUsed time.Time
+}
+
+// lastNProjects returns up to n distinct recent projects, most recently used
+// first, or with -frequency most used within usageWindow first.
+func lastNProjects(n int, exclude string) ([]projectUsage, error) {
+	f, err := openTimelog()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	type use struct {
+		project string
+		t       time.Time
+	}
+	var allProjects []use
+	scanner := newScanner(f)
+	for scanner.Scan() {
+		line := trimLine(scanner.Text())
+		if strings.HasPrefix(line, "i ") {
+			proj, _ := entryProject(line)
+			t, err := entryTime(line)
+			if proj != "" && err == nil {
+				allProjects = append(allProjects, use{proj, t})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// Reverse for most recent first
+	slices.Reverse(allProjects)
+
+	// Deduplicate, preserving order, and exclude if needed
+	cutoff := time.Now().Add(-usageWindow)
+	unique := []projectUsage{}
+	index := make(map[string]int)
+	for _, u := range allProjects {
+		if u.project == exclude {
+			continue
+		}
+		i, seen := index[u.project]
+		if !seen {
+			if len(unique) == n && !byFrequency {
+				continue
+			}
+			i = len(unique)
+			index[u.project] = i
+			unique = append(unique, projectUsage{Project: u.project, LastUsed: u.t})
+		}
+		if u.t.After(cutoff) {
+			unique[i].Count++
+		}
+	}
+	if byFrequency {
+		// stable, so equally used projects stay most recent first
+		slices.SortStableFunc(unique, func(a, b projectUsage) int { return b.Count - a.Count })
+		unique = unique[:min(n, len(unique))]
+	}
+	return unique, nil
+}
+
+// displayDate is t's date for listings: relativeDay with relative dates,
+// otherwise the date itself
+func displayDate(t time.Time) string {
+	t = displayTime(t)
+	if resolveSetting("dates", datesFlag, "TT_DATES", "absolute").Value == "relative" {
+		return relativeDay(t)
+	}
+	return t.Format(dateFormat)
+}
+
+// relativeDay describes t's date relative to today: "today", "yesterday",
+// "last Tue" within the past week, otherwise the date itself.
+func relativeDay(t time.Time) string {
+	now := displayTime(reportNow())
+	// Step back by calendar days, as a day across a DST change isn't 24 hours
+	date := t.Format(dateFormat)
+	for days := range 7 {
+		if now.AddDate(0, 0, -days).Format(dateFormat) != date {
+			continue
+		}
+		switch days {
+		case 0:
+			return "today"
+		case 1:
+			return "yesterday"
+		default:
+			return "last " + t.Weekday().String()[:3]
+		}
+	}
+	return date
+}
+
+// Returns hours worked for today
+func hoursToday(group bool) (float64, map[string]float64, map[string]map[string]float64, []string, error) {
+	return hoursForDay(0, group)
+}
+
+// parsedEntry is an i or o line with its timestamp parsed, and the project
+// and note, untrimmed, after it
+type parsedEntry struct {
+	Type string
+	Time time.Time
+	Rest string
+}
+
+// entryCache is what the cache file holds: the parsed entries of a timelog,
+// and what they were parsed from, to tell when they are stale
+type entryCache struct {
+	Path            string
+	Size            int64
+	ModTime         time.Time
+	TimestampFormat string
+	Zone            string
+	Entries         []parsedEntry
+}
+
+// parsedEntries reads the i and o entries of the timelog. With the cache on,
+// a single local timelog's entries are kept in a file beside it, reused
+// while the timelog's size and modification time are unchanged, so repeated
+// reports over a long log skip parsing. A cache that can't be read is
+// ignored and rebuilt.
+func parsedEntries() ([]parsedEntry, error) {
+	var key *entryCache
+	if resolveSetting("cache", cacheFlag, "TT_CACHE", "off").Value == "on" && asOf.IsZero() {
+		if paths, err := timelogPaths(); err == nil && len(paths) == 1 && !isURL(paths[0]) {
+			if info, err := os.Stat(paths[0]); err == nil {
+				zone, _ := time.Now().Zone()
+				key = &entryCache{Path: paths[0], Size: info.Size(), ModTime: info.ModTime(), TimestampFormat: timestampFormat, Zone: time.Local.String() + zone}
+				if entries, ok := loadEntryCache(key); ok {
+					return entries, nil
+				}
+			}
+		}
+	}
+
+	f, err := openTimelog()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := []parsedEntry{}
+	scanner := newScanner(f)
+	for scanner.Scan() {
+		line := trimLine(scanner.Text())
+		if !strings.HasPrefix(line, "i ") && !strings.HasPrefix(line, "o ") {
+			continue
+		}
+		t, rest, err := parseEntryLine(line)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, parsedEntry{line[:1], t, rest})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if key != nil {
+		key.Entries = entries
+		saveEntryCache(key)
+	}
+	return entries, nil
+}
+
+// entryCachePath is the cache file for a timelog, hidden beside it
+func entryCachePath(timelog string) string {
+	return filepath.Join(filepath.Dir(timelog), "."+filepath.Base(timelog)+".cache")
+}
+
+// loadEntryCache returns the cached entries if the cache matches key
+func loadEntryCache(key *entryCache) ([]parsedEntry, bool) {
+	f, err := os.Open(entryCachePath(key.Path))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	var c entryCache
+	if err := gob.NewDecoder(f).Decode(&c); err != nil {
+		return nil, false
+	}
+	if c.Size != key.Size || !c.ModTime.Equal(key.ModTime) || c.TimestampFormat != key.TimestampFormat || c.Zone != key.Zone {
+		return nil, false
+	}
+	for i := range c.Entries {
+		c.Entries[i].Time = c.Entries[i].Time.Local()
+	}
+	return c.Entries, true
+}
+
+// saveEntryCache writes the cache through a temporary file, so a reader
+// never sees half of it. Failing to write it only costs speed.
+func saveEntryCache(c *entryCache) {
+	path := entryCachePath(c.Path)
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return
+	}
+	if err := gob.NewEncoder(tmp).Encode(c); err != nil || tmp.Close() != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+func hoursForRange(startDate, endDate string, group bool) (float64, map[string]float64, map[string]map[string]float64, []string, error) {
+	boundary, err := dayBoundary()
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+
+	parsed, err := parsedEntries()
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+	// Pair the whole log in chronological order, so a hand-edited, out of
+	// order file still totals correctly and a session crossing the edge of
+	// the range keeps both ends. The sort is stable, keeping equal times in
+	// file order. As in readSessions, each in pairs with the next out, and
+	// an in followed by another in is dropped.
+	sorted := slices.Clone(parsed)
+	slices.SortStableFunc(sorted, func(a, b parsedEntry) int { return a.Time.Compare(b.Time) })
+	type span struct {
+		in, out time.Time
+		// project keeps any note so reports can group by it
+		project string
+	}
+	var spans []span
+	var cur *parsedEntry
+	for i, e := range sorted {
+		switch {
+		case e.Type == "i":
+			cur = &sorted[i]
+		case cur != nil:
+			spans = append(spans, span{cur.Time, e.Time, strings.TrimSpace(cur.Rest)})
+			cur = nil
+		}
+	}
+
+	today := logicalDate(reportNow(), boundary)
+	openIncluded = openShare{}
+	openAppended := false
+	if cur != nil {
+		open := span{in: cur.Time, project: strings.TrimSpace(cur.Rest)}
+		openDate := logicalDate(open.in, boundary)
+		switch {
+		case openDate < today:
+			// A session left open on a day before today, such as a
+			// forgotten clock out, counts until the end of the day it
+			// started rather than running on to now.
+			open.out = endOfDay(open.in, boundary)
+			if openDate >= startDate && openDate <= endDate {
+				fmt.Fprintf(os.Stderr, "Warning: session open since %s counted until %s; clock out to correct it\n", open.in.Format(dateTimeFormat), open.out.Format(dateTimeFormat))
+			}
+			spans = append(spans, open)
+		case !isExcludedOpen(open.project):
+			open.out = reportNow()
+			if includeOpenAs != "" {
+				t, err := parseClockTime(includeOpenAs)
+				if err != nil {
+					return 0, nil, nil, nil, err
+				}
+				if t.Before(open.in) {
+					return 0, nil, nil, nil, fmt.Errorf("-include-open-as %s is before the open session started (%s)", includeOpenAs, open.in.Format(dateTimeFormat))
+				}
+				open.out = t
+			}
+			spans = append(spans, open)
+			openAppended = true
+		}
+	}
+
+	// pieces splits a session at each day boundary, keeping the parts on
+	// dates in the range. The times are shifted by the day boundary, so
+	// "midnight" is where it falls.
+	pieces := func(sp span) [][2]time.Time {
+		if logicalDate(sp.out, boundary) < startDate || logicalDate(sp.in, boundary) > endDate {
+			return nil
+		}
+		var kept [][2]time.Time
+		for _, p := range splitAtMidnight(sp.in.Add(-boundary), sp.out.Add(-boundary)) {
+			if date := p[0].Format(dateFormat); date >= startDate && date <= endDate && p[1].After(p[0]) {
+				kept = append(kept, [2]time.Time{p[0].Add(boundary), p[1].Add(boundary)})
+			}
+		}
+		return kept
+	}
+
+	var entries []string
+	var total time.Duration
+	var weekend []time.Weekday
+	if excludeWeekends {
+		if weekend, err = weekendDays(); err != nil {
+			return 0, nil, nil, nil, err
+		}
+	}
+	if matchingDays && projectRegex == nil {
+		return 0, nil, nil, nil, errors.New("-sum-only-matching-days needs -project-regex to match days by")
+	}
+	// With -sum-only-matching-days, first find the days with a matching
+	// session, then count every session on those days.
+	var matchedDays map[string]bool
+	if matchingDays {
+		matchedDays = make(map[string]bool)
+		for _, sp := range spans {
+			if project, _ := splitProjectNote(sp.project); projectRegex.MatchString(project) {
+				for _, p := range pieces(sp) {
+					matchedDays[logicalDate(p[0], boundary)] = true
+				}
+			}
+		}
+	}
+	var gap time.Duration
+	if combineAdjacent {
+		if gap, err = combineGap(); err != nil {
+			return 0, nil, nil, nil, err
+		}
+	}
+	// addEntry appends a session's entry, or with -combine-adjacent adds it
+	// to the last one when that is the same project on the same day and
+	// ended less than combine_gap before this began. The total is the same
+	// either way; only the number of entries changes.
+	var lastDur time.Duration
+	var lastDate, lastProject string
+	var lastOut time.Time
+	addEntry := func(d time.Duration, date, project string, in, out time.Time) {
+		if combineAdjacent && len(entries) > 0 && date == lastDate && project == lastProject && !in.Before(lastOut) && in.Sub(lastOut) < gap {
+			lastDur += d
+			entries[len(entries)-1] = fmt.Sprintf("%s %s %s", lastDur, date, project)
+		} else {
+			lastDur = d
+			entries = append(entries, fmt.Sprintf("%s %s %s", d, date, project))
+		}
+		lastDate, lastProject, lastOut = date, project, out
+	}
+	filtered := 0
+	for i, sp := range spans {
+		dur := sp.out.Sub(sp.in)
+		if dur <= 0 {
+			continue
+		}
+		parts := pieces(sp)
+		if len(parts) == 0 {
+			continue
+		}
+		if dur < minDuration {
+			filtered++
+			continue
+		}
+		if !matchingDays && projectRegex != nil {
+			if project, _ := splitProjectNote(sp.project); !projectRegex.MatchString(project) {
+				continue
+			}
+		}
+		// Each day's part is an entry of its own, so a session crossing
+		// midnight counts towards both days, and only the weekend part of
+		// one crossing into or out of the weekend is dropped.
+		for _, p := range parts {
+			date := logicalDate(p[0], boundary)
+			day, _ := time.ParseInLocation(dateFormat, date, time.Local)
+			if excludedDates[date] || (matchingDays && !matchedDays[date]) || slices.Contains(weekend, day.Weekday()) {
+				continue
+			}
+			d := billableDuration(p[1].Sub(p[0]))
+			total += d
+			addEntry(d, date, sp.project, p[0], p[1])
+			if openAppended && i == len(spans)-1 {
+				project, _ := splitProjectNote(sp.project)
+				openIncluded = openShare{openIncluded.duration + p[1].Sub(p[0]), project, date}
+			}
+		}
+	}
+
+	if verbose && filtered > 0 {
+		fmt.Fprintf(os.Stderr, "Filtered %d sessions shorter than %s\n", filtered, minDuration)
+	}
+
+	// With -fill-gaps-as, the time between one session ending and the next
+	// starting on the same day, within the working window, is counted under
+	// that project. Nothing is written to the log.
+	if fillGapsAs != "" && (projectRegex == nil || matchingDays || projectRegex.MatchString(fillGapsAs)) {
+		windowStart, windowEnd, err := workWindow()
+		if err != nil {
+			return 0, nil, nil, nil, err
+		}
+		for i := 0; i+1 < len(spans); i++ {
+			date := logicalDate(spans[i].out, boundary)
+			if date != logicalDate(spans[i+1].in, boundary) || date < startDate || date > endDate || excludedDates[date] || (matchingDays && !matchedDays[date]) {
+				continue
+			}
+			day, _ := time.ParseInLocation(dateFormat, date, time.Local)
+			if excludeWeekends && slices.Contains(weekend, day.Weekday()) {
+				continue
+			}
+			from, to := spans[i].out, spans[i+1].in
+			if start := day.Add(windowStart); start.After(from) {
+				from = start
+			}
+			if end := day.Add(windowEnd); end.Before(to) {
+				to = end
+			}
+			if gap := to.Sub(from); gap > 0 {
+				total += gap
+				entries = append(entries, fmt.Sprintf("%s %s %s", gap, date, fillGapsAs))
+			}
+		}
+	}
+
+	if path := resolveSetting("project_aliases", aliasesFlag, "TT_PROJECT_ALIASES", "").Value; path != "" {
+		aliases, err := readAliasFile(path)
+		if err != nil {
+			return 0, nil, nil, nil, err
+		}
+		entries = aliasEntries(entries, aliases)
+		openIncluded.project = aliasProject(openIncluded.project, aliases)
+	}
+	if normalizeCase {
+		entries = foldEntryCase(entries)
+	}
+	if group {
+		projectTotals, projectPaths := groupFlatTotals(entries)
+		return total.Hours(), projectTotals, projectPaths, entries, nil
+	}
+	return total.Hours(), nil, nil, entries, nil
+}
+
+// foldEntryCase rewrites each entry's project so segments differing only in
+// case use one spelling, the most common one at that place in the hierarchy
+// (the first seen on a tie), so their hours group together.
+func foldEntryCase(entries []string) []string {
+	type spelling struct {
+		name  string
+		count int
+	}
+	spellings := make(map[string][]spelling)
+	for _, entry := range entries {
+		_, _, path, ok := splitEntry(entry)
+		if !ok {
+			continue
+		}
+		path, _ = splitProjectNote(path)
+		segments := projectSegments(path)
+		for i, seg := range segments {
+			key := strings.ToLower(strings.Join(segments[:i+1], ":"))
+			j := slices.IndexFunc(spellings[key], func(sp spelling) bool { return sp.name == seg })
+			if j < 0 {
+				spellings[key] = append(spellings[key], spelling{seg, 0})
+				j = len(spellings[key]) - 1
+			}
+			spellings[key][j].count++
+		}
+	}
+
+	folded := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		d, date, path, ok := splitEntry(entry)
+		if !ok {
+			folded = append(folded, entry)
+			continue
+		}
+		path, note := splitProjectNote(path)
+		segments := projectSegments(path)
+		for i := range segments {
+			key := strings.ToLower(strings.Join(segments[:i+1], ":"))
+			best := spellings[key][0]
+			for _, sp := range spellings[key][1:] {
+				if sp.count > best.count {
+					best = sp
+				}
+			}
+			segments[i] = best.name
+		}
+		project := strings.Join(segments, ":")
+		if note != "" {
+			project += "  " + note
+		}
+		folded = append(folded, fmt.Sprintf("%s %s %s", d, date, project))
+	}
+	return folded
+}
+
+// aliasEntries renames each entry's project with aliasProject, so acme:dev
+// becomes newco:dev given acme = newco
+func aliasEntries(entries []string, aliases map[string]string) []string {
+	renamed := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		d, date, path, ok := splitEntry(entry)
+		if !ok {
+			renamed = append(renamed, entry)
+			continue
+		}
+		path, note := splitProjectNote(path)
+		project := aliasProject(path, aliases)
+		if note != "" {
+			project += "  " + note
+		}
+		renamed = append(renamed, fmt.Sprintf("%s %s %s", d, date, project))
+	}
+	return renamed
+}
+
+// aliasProject renames project by the longest alias matching it or one of
+// its parents
+func aliasProject(project string, aliases map[string]string) string {
+	segments := projectSegments(project)
+	for i := len(segments); i > 0; i-- {
+		if canonical, ok := aliases[strings.Join(segments[:i], ":")]; ok {
+			return strings.Join(append(projectSegments(canonical), segments[i:]...), ":")
+		}
+	}
+	return project
+}
+
+// displayTime converts t to the -tz-display zone, if one was given, for
+// printing. Stored times and durations are unaffected.
+func displayTime(t time.Time) time.Time {
+	if displayZone == nil {
+		return t
+	}
+	return t.In(displayZone)
+}
+
+// billableDuration applies -round and then -unit billing to a session.
+// -round rounds to a multiple of its increment in the -round-dir direction.
+// With -unit any non-zero session is charged at least one unit and is
+// rounded up to a whole number of units. A zero session stays zero.
+func billableDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	if roundTo > 0 {
+		switch roundDir {
+		case "floor":
+			d = d / roundTo * roundTo
+		case "ceil":
+			d = (d + roundTo - 1) / roundTo * roundTo
+		default:
+			d = d.Round(roundTo)
+		}
+	}
+	if billUnit <= 0 || d <= 0 {
+		return d
+	}
+	return (d + billUnit - 1) / billUnit * billUnit
+}
+
+// splitAtMidnight breaks the interval from start to end into pieces that
+// each fall within a single calendar day
+func splitAtMidnight(start, end time.Time) [][2]time.Time {
+	var pieces [][2]time.Time
+	for start.Before(end) {
+		y, m, d := start.Date()
+		midnight := time.Date(y, m, d+1, 0, 0, 0, 0, start.Location())
+		if !midnight.Before(end) {
+			break
+		}
+		pieces = append(pieces, [2]time.Time{start, midnight})
+		start = midnight
+	}
+	return append(pieces, [2]time.Time{start, end})
+}
+
+func hoursForDay(daysAgo int, group bool) (float64, map[string]float64, map[string]map[string]float64, []string, error) {
+	boundary, err := dayBoundary()
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+	targetDate := logicalDate(reportNow().AddDate(0, 0, -daysAgo), boundary)
+	return hoursForRange(targetDate, targetDate, group)
+}
+
+// isExcludedOpen reports whether an open session on project, given with any
+// note, is left out by -exclude-open-project
+func isExcludedOpen(project string) bool {
+	if excludeOpenProject == "" {
+		return false
+	}
+	project, _ = splitProjectNote(project)
+	return project == excludeOpenProject || strings.HasPrefix(project, excludeOpenProject+":")
+}
+
+// endOfDay is when the working day t falls in ends
+func endOfDay(t time.Time, boundary time.Duration) time.Time {
+	day, _ := time.ParseInLocation(dateFormat, logicalDate(t, boundary), time.Local)
+	return day.AddDate(0, 0, 1).Add(boundary)
+}
+
+// displayDayDetail lists each session started on the day daysAgo with its
+// start, end and duration, for -detail
+func displayDayDetail(daysAgo int) error {
+	boundary, err := dayBoundary()
+	if err != nil {
+		return err
+	}
+	sessions, err := loadSessions()
+	if err != nil {
+		return err
+	}
+	var gap time.Duration
+	if combineAdjacent {
+		if gap, err = combineGap(); err != nil {
+			return err
+		}
+	}
+	// A combined row spans its sessions but its duration is only the time
+	// worked in them, leaving out the gaps between
+	type row struct {
+		in, out  time.Time
+		end      string
+		state    string
+		duration time.Duration
+		project  string
+		note     string
+	}
+	var rows []row
+	date := logicalDate(reportNow().AddDate(0, 0, -daysAgo), boundary)
+	for _, s := range sessions {
+		if logicalDate(s.In, boundary) != date {
+			continue
+		}
+		end, state := "", ""
+		duration := s.end().Sub(s.In)
+		switch {
+		case s.Open && date < logicalDate(reportNow(), boundary):
+			// counted until the end of its day, as in the total
+			end, state = "(open)", "  (open, counted to the end of the day)"
+			duration = endOfDay(s.In, boundary).Sub(s.In)
+		case s.Open:
+			end, state = "(open)", "  (open)"
+		default:
+			end = displayTime(s.Out).Format("15:04:05")
+		}
+		if last := len(rows) - 1; combineAdjacent && last >= 0 && rows[last].state == "" && rows[last].project == s.Project && rows[last].note == s.Note && s.In.Sub(rows[last].out) < gap {
+			rows[last].out, rows[last].end, rows[last].state = s.Out, end, state
+			rows[last].duration += duration
+			continue
+		}
+		rows = append(rows, row{s.In, s.Out, end, state, duration, s.Project, s.Note})
+	}
+	for _, r := range rows {
+		fmt.Printf("%s - %-8s %10s  %s%s\n", displayTime(r.in).Format("15:04:05"), r.end, formatDuration(r.duration), r.project, r.state)
+	}
+	return nil
+}
+
+// printError reports the error a command failed with. With -output it goes
+// to stderr rather than into the file, and tt exits 1, so a scheduled report
+// can't fail unnoticed.
+func printError(err error) {
+	if outputPath != "" {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Error:", err)
+}
+
+// createOutput creates or truncates path for -output, making any missing
+// parent directories first
+func createOutput(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+// combineGap is the combine_gap setting: sessions of one project closer
+// together than this are one session with -combine-adjacent
+func combineGap() (time.Duration, error) {
+	value := resolveSetting("combine_gap", combineGapFlag, "TT_COMBINE_GAP", "5m").Value
+	gap, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid combine_gap %q: %w", value, err)
+	}
+	return gap, nil
+}
+
+func hoursThisWeek(group bool) (float64, map[string]float64, map[string]map[string]float64, []string, error) {
+	return hoursForWeek(0, group)
+}
+
+func hoursForWeek(weeksAgo int, group bool) (float64, map[string]float64, map[string]map[string]float64, []string, error) {
+	start, end := weekRange(weeksAgo)
+	return hoursForRange(start, end, group)
+}
+
+// weekRange returns the first and last dates of the week weeksAgo weeks
+// before the current one. Weeks run Monday to Sunday unless weekStart says
+// otherwise.
+func weekRange(weeksAgo int) (string, string) {
+	now := reportNow()
+	start, _ := weekStart()
+	offset := (int(now.Weekday()) - int(start) + 7) % 7
+	first := now.AddDate(0, 0, -offset-7*weeksAgo)
+	last := first.AddDate(0, 0, 6)
+	return first.Format(dateFormat), last.Format(dateFormat)
+}
+
+// weekStart returns the day weeks start on, from -week-start (or the day
+// after -end-of-week), TT_WEEK_START or the week_start setting. It is
+// Monday by default.
+func weekStart() (time.Weekday, error) {
+	return parseWeekday(resolveSetting("week_start", weekStartFlag, "TT_WEEK_START", "monday").Value)
+}
+
+// monthRange returns the first and last dates of the month monthsAgo
+// months before the current one
+func monthRange(monthsAgo int) (string, string) {
+	now := reportNow()
+	first := time.Date(now.Year(), now.Month()-time.Month(monthsAgo), 1, 0, 0, 0, 0, time.Local)
+	last := first.AddDate(0, 1, -1)
+	return first.Format(dateFormat), last.Format(dateFormat)
+}
+
+// reportAggregate prints the total for each of the last n days, weeks or
+// months, oldest first, as a two-column series. With -rolling k each period
+// also shows the average of it and the k-1 before it; those earlier periods
+// are read even when before the series, so the first averages are complete.
+func reportAggregate(by string, n int) error {
+	n = max(1, n)
+	k := max(1, rolling)
+	var w rowWriter
+	if csvOutput {
+		w = newRowWriter()
+		if rolling > 0 {
+			w.Write([]string{"period", "hours", "rolling_average"})
+		} else {
+			w.Write([]string{"period", "hours"})
+		}
+	}
+	var window []float64
+	for i := n + k - 2; i >= 0; i-- {
+		var label, start, end string
+		switch by {
+		case "day":
+			start = reportNow().AddDate(0, 0, -i).Format(dateFormat)
+			end, label = start, start
+		case "week":
+			start, end = weekRange(i)
+			label = start
+		case "month":
+			start, end = monthRange(i)
+			label = start[:7]
+		default:
+			return fmt.Errorf("unknown -by %q, expected day, week or month", by)
+		}
+		hours, _, _, _, err := hoursForRange(start, end, false)
+		if err != nil {
+			return err
+		}
+		if window = append(window, hours); len(window) > k {
+			window = window[1:]
+		}
+		if i >= n {
+			continue
+		}
+		var windowTotal float64
+		for _, h := range window {
+			windowTotal += h
+		}
+		average := windowTotal / float64(len(window))
+		switch {
+		case w != nil && rolling > 0:
+			w.Write([]string{label, hoursValue(hours), hoursValue(average)})
+		case w != nil:
+			w.Write([]string{label, hoursValue(hours)})
+		case rolling > 0:
+			fmt.Printf("%-10s %9s %9s\n", label, formatHours(hours), formatHours(average))
+		default:
+			fmt.Printf("%-10s %9s\n", label, formatHours(hours))
+		}
+	}
+	if w != nil {
+		w.Flush()
+		return w.Error()
+	}
+	return nil
+}
+
+// reportMonthGrid prints a calendar of the month monthsAgo months back, one
+// row per Monday to Sunday week, with each day's total beside its date.
+// Days with no hours show just the date.
+func reportMonthGrid(monthsAgo int) error {
+	start, end := monthRange(monthsAgo)
+	first, err := time.ParseInLocation(dateFormat, start, time.Local)
+	if err != nil {
+		return err
+	}
+	last, err := time.ParseInLocation(dateFormat, end, time.Local)
+	if err != nil {
+		return err
+	}
+	fmt.Println(first.Format("January 2006"))
+	fmt.Println(" Mon      Tue      Wed      Thu      Fri      Sat      Sun")
+
+	// Leading blanks line the first day up under its weekday
+	column := (int(first.Weekday()) + 6) % 7
+	row := strings.Repeat(" ", 9*column)
+	var total float64
+	for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+		date := d.Format(dateFormat)
+		hours, _, _, _, err := hoursForRange(date, date, false)
+		if err != nil {
+			return err
+		}
+		total += hours
+		row += fmt.Sprintf("%2d", d.Day())
+		if hours > 0 {
+			row += fmt.Sprintf(" %5s", hoursValue(hours))
+		}
+		row += strings.Repeat(" ", 9*(column+1)-len(row))
+		if column = (column + 1) % 7; column == 0 || d.Equal(last) {
+			fmt.Println(strings.TrimRight(row, " "))
+			row = ""
+		}
+	}
+	fmt.Println("--------------------")
+	fmt.Printf("Total: %s\n", formatHours(total))
+	return nil
+}
+
+// reportDays prints the hours for each day from start to end, with a
+// cumulative column when -running-total is set. With -carryover each day
+// also shows the difference from -target and the running flextime balance.
+func reportDays(start, end string) error {
+	if carryover && targetHours <= 0 && dayTargets == nil {
+		return errors.New("-carryover needs a daily -target in hours")
+	}
+	first, err := time.ParseInLocation(dateFormat, start, time.Local)
+	if err != nil {
+		return err
+	}
+	last, err := time.ParseInLocation(dateFormat, end, time.Local)
+	if err != nil {
+		return err
+	}
+	var w rowWriter
+	if csvOutput {
+		w = newRowWriter()
+		var header []string
+		switch {
+		case carryover:
+			header = []string{"date", hoursColumn(), "delta", "balance"}
+		case runningTotal:
+			header = []string{"date", hoursColumn(), "running_total"}
+		default:
+			header = []string{"date", hoursColumn()}
+		}
+		if weekNumbers {
+			header = append([]string{"week"}, header...)
+		}
+		w.Write(header)
+	}
+	// week numbers are always three characters, W01 to W53, so the
+	// columns stay aligned
+	indent := ""
+	if weekNumbers {
+		indent = "    "
+	}
+	weekend, err := weekendDays()
+	if err != nil {
+		return err
+	}
+	var total, balance float64
+	days := 0
+	for d := first; !d.After(last); d = d.AddDate(0, 0, 1) {
+		date := d.Format(dateFormat)
+		label := date + " " + d.Weekday().String()[:3]
+		var week []string
+		if weekNumbers {
+			_, n := d.ISOWeek()
+			label = fmt.Sprintf("W%02d %s", n, label)
+			week = []string{fmt.Sprintf("W%02d", n)}
+		}
+		hours, _, _, _, err := hoursForRange(date, date, false)
+		if err != nil {
+			return err
+		}
+		total += hours
+		isWeekend := slices.Contains(weekend, d.Weekday())
+		// weekend hours still count towards the total, but with
+		// -workdays-only weekend days don't count towards the average.
+		// Excluded dates count towards neither.
+		if (!workdaysOnly || !isWeekend) && !excludedDates[date] {
+			days++
+		}
+		delta := hours - dayTarget(d, isWeekend)
+		balance += delta
+		switch {
+		case w != nil && carryover:
+			w.Write(append(week, date, hoursValue(hours), hoursValue(delta), hoursValue(balance)))
+		case w != nil && runningTotal:
+			w.Write(append(week, date, hoursValue(hours), hoursValue(total)))
+		case w != nil:
+			w.Write(append(week, date, hoursValue(hours)))
+		case carryover:
+			fmt.Printf("%s %9s %9s %9s\n", label, formatHours(hours), signedHours(delta), signedHours(balance))
+		case runningTotal:
+			fmt.Printf("%s %9s %9s\n", label, formatHours(hours), formatHours(total))
+		default:
+			fmt.Printf("%s %9s\n", label, formatHours(hours))
+		}
+	}
+	if w != nil {
+		w.Flush()
+		return w.Error()
+	}
+	fmt.Println("--------------------")
+	fmt.Printf("Total:         %s%9s\n", indent, formatHours(total))
+	if days > 0 {
+		fmt.Printf("Average:       %s%9s over %d days\n", indent, formatHours(total/float64(days)), days)
+	}
+	if carryover {
+		fmt.Printf("Balance:       %s%9s\n", indent, signedHours(balance))
+	}
+	return nil
+}
+
+// readDateFile reads a file of dates, one 2006-01-02 per line, skipping
+// blank lines and # comments
+func readDateFile(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dates := make(map[string]bool)
+	scanner := newScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := trimLine(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := time.Parse(dateFormat, line); err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid date %q", path, lineNum, line)
+		}
+		dates[line] = true
+	}
+	return dates, scanner.Err()
+}
+
+// readAliasFile reads "old = canonical" project names, one pair per line,
+// skipping blank lines and # comments
+func readAliasFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	aliases := make(map[string]string)
+	scanner := newScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		old, canonical, ok := strings.Cut(line, "=")
+		old, canonical = strings.TrimSpace(old), strings.TrimSpace(canonical)
+		if !ok || old == "" || canonical == "" {
+			return nil, fmt.Errorf("%s line %d: expected old = canonical, got %q", path, lineNum, line)
+		}
+		aliases[old] = canonical
+	}
+	return aliases, scanner.Err()
+}
+
+// targetFile holds daily targets in hours for particular dates and for
+// weekdays
+type targetFile struct {
+	dates    map[string]float64
+	weekdays map[time.Weekday]float64
+}
+
+// readTargetFile reads "date-or-weekday hours" lines, such as
+// "2024-02-09 4" or "fri 6", skipping blank lines and # comments
+func readTargetFile(path string) (*targetFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	targets := &targetFile{make(map[string]float64), make(map[time.Weekday]float64)}
+	scanner := newScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected a date or weekday and hours, got %q", path, lineNum, line)
+		}
+		hours, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || hours < 0 {
+			return nil, fmt.Errorf("%s line %d: invalid hours %q", path, lineNum, fields[1])
+		}
+		if isDate(fields[0]) {
+			targets.dates[fields[0]] = hours
+		} else if d, err := parseWeekday(fields[0]); err == nil {
+			targets.weekdays[d] = hours
+		} else {
+			return nil, fmt.Errorf("%s line %d: %q is neither a date nor a weekday", path, lineNum, fields[0])
+		}
+	}
+	return targets, scanner.Err()
+}
+
+// dayTarget is the hours expected on day d. A date in the -target-from-file
+// file comes first, then its weekday there; otherwise it is -target, or
+// nothing on a weekend, so any hours worked then are surplus.
+func dayTarget(d time.Time, isWeekend bool) float64 {
+	if dayTargets != nil {
+		if hours, ok := dayTargets.dates[d.Format(dateFormat)]; ok {
+			return hours
+		}
+		if hours, ok := dayTargets.weekdays[d.Weekday()]; ok {
+			return hours
+		}
+	}
+	if isWeekend {
+		return 0
+	}
+	return targetHours
+}
+
+// dayBoundary returns how long after midnight the working day starts, from
+// -day-boundary, TT_DAY_BOUNDARY or the day_boundary setting as HH:MM.
+// It is zero, midnight, by default.
+func dayBoundary() (time.Duration, error) {
+	value := resolveSetting("day_boundary", dayBoundaryFlag, "TT_DAY_BOUNDARY", "00:00").Value
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid day boundary %q, expected HH:MM", value)
+	}
+	return sinceMidnight(t), nil
+}
+
+// sinceMidnight is the time of day of a parsed HH:MM
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+}
+
+// workWindow returns the start and end of the working day, as offsets from
+// midnight, from -work-window, TT_WORK_WINDOW or the work_window setting as
+// HH:MM-HH:MM. It is 09:00-17:00 by default.
+func workWindow() (time.Duration, time.Duration, error) {
+	value := resolveSetting("work_window", workWindowFlag, "TT_WORK_WINDOW", "09:00-17:00").Value
+	from, to, _ := strings.Cut(value, "-")
+	start, err1 := time.Parse("15:04", strings.TrimSpace(from))
+	end, err2 := time.Parse("15:04", strings.TrimSpace(to))
+	if err1 != nil || err2 != nil || !start.Before(end) {
+		return 0, 0, fmt.Errorf("invalid work window %q, expected HH:MM-HH:MM", value)
+	}
+	return sinceMidnight(start), sinceMidnight(end), nil
+}
+
+// logicalDate is the date of the working day t falls in, which starts at
+// the day boundary rather than at midnight
+func logicalDate(t time.Time, boundary time.Duration) string {
+	return t.Add(-boundary).Format(dateFormat)
+}
+
+// weekendDays returns the configured weekend, "sat,sun" by default
+func weekendDays() ([]time.Weekday, error) {
+	var days []time.Weekday
+	for name := range strings.SplitSeq(resolveSetting("weekend", weekendFlag, "TT_WEEKEND", "sat,sun").Value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		d, err := parseWeekday(name)
+		if err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	return days, nil
+}
+
+// reportWeekday prints the hours for each occurrence of the named weekday over
+// the last n weeks, followed by their sum and average.
+func reportWeekday(name string, n int) error {
+	day, err := parseWeekday(name)
+	if err != nil {
+		return err
+	}
+	n = max(1, n)
+	now := reportNow()
+	latest := now.AddDate(0, 0, -((int(now.Weekday()) - int(day) + 7) % 7))
+
+	var total float64
+	for i := n - 1; i >= 0; i-- {
+		date := latest.AddDate(0, 0, -7*i).Format(dateFormat)
+		hours, _, _, _, err := hoursForRange(date, date, false)
+		if err != nil {
+			return err
+		}
+		total += hours
+		fmt.Printf("%s %s %9s\n", date, day.String()[:3], formatHours(hours))
+	}
+	fmt.Println("--------------------")
+	fmt.Printf("Total:   %9s\n", formatHours(total))
+	fmt.Printf("Average: %9s\n", formatHours(total/float64(n)))
+	return nil
+}
+
+// reportWeekdayAverages prints the average hours worked on each weekday over
+// the last n weeks, starting from the configured week start. Days with no
+// work are left out of a weekday's average, so the count of days worked is
+// shown beside it as the sample size.
+func reportWeekdayAverages(n int) error {
+	n = max(1, n)
+	first, err := weekStart()
+	if err != nil {
+		return err
+	}
+	var totals [7]float64
+	var worked, seen [7]int
+	now := reportNow()
+	for i := 7*n - 1; i >= 0; i-- {
+		day := now.AddDate(0, 0, -i)
+		date := day.Format(dateFormat)
+		hours, _, _, _, err := hoursForRange(date, date, false)
+		if err != nil {
+			return err
+		}
+		seen[day.Weekday()]++
+		if hours > 0 {
+			totals[day.Weekday()] += hours
+			worked[day.Weekday()]++
+		}
+	}
+	for i := range 7 {
+		d := (first + time.Weekday(i)) % 7
+		var avg float64
+		if worked[d] > 0 {
+			avg = totals[d] / float64(worked[d])
+		}
+		fmt.Printf("%s %16s  (%d of %d days worked)\n", d.String()[:3], formatHours(avg), worked[d], seen[d])
+	}
+	return nil
+}
+
+// parseWeekday accepts full or three-letter weekday names in any case
+func parseWeekday(s string) (time.Weekday, error) {
+	s = strings.ToLower(s)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		if s == name || s == name[:3] {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", s)
+}
+
+func groupFlatTotals(entries []string) (map[string]float64, map[string]map[string]float64) {
+	// Sum exact durations and only convert to hours at the end
+	projectDurations := make(map[string]time.Duration)
+	pathDurations := make(map[string]map[string]time.Duration)
+	for _, entry := range entries {
+		d, _, path, ok := splitEntry(entry)
+		if !ok {
+			continue
+		}
+		path, _ = splitProjectNote(path)
+		segments := projectSegments(path)
+		if len(segments) == 0 {
+			continue
+		}
+		project := segments[0]
+		path = strings.Join(segments, ":")
+		projectDurations[project] += d
+		if pathDurations[project] == nil {
+			pathDurations[project] = make(map[string]time.Duration)
+		}
+		pathDurations[project][path] += d
+	}
+	projectTotals := make(map[string]float64)
+	projectPaths := make(map[string]map[string]float64)
+	for project, d := range projectDurations {
+		projectTotals[project] = d.Hours()
+		projectPaths[project] = make(map[string]float64)
+		for path, pd := range pathDurations[project] {
+			projectPaths[project][path] = pd.Hours()
+		}
+	}
+	return projectTotals, projectPaths
+}
+
+// Parse entries into structured data
+func parseEntries(entries []string) []Entry {
+	result := []Entry{}
+	for _, entry := range entries {
+		d, date, path, ok := splitEntry(entry)
+		if !ok {
+			continue
+		}
+		path, note := splitProjectNote(path)
+		segments := projectSegments(path)
+		if len(segments) == 0 {
+			continue
+		}
+		result = append(result, Entry{
+			Project:  segments[0],
+			Segments: segments,
+			Hours:    d.Hours(),
+			Date:     date,
+			Note:     note,
+		})
+	}
+	return result
+}
+
+// projectSegments splits a project into its hierarchy. Colons always
+// separate levels; spaces are part of a segment's name. Space around a
+// colon is ignored and empty segments are dropped, so "a : b" and "a::b"
+// both mean a:b.
+func projectSegments(project string) []string {
+	var segments []string
+	for seg := range strings.SplitSeq(project, ":") {
+		if seg = strings.TrimSpace(seg); seg != "" {
+			segments = append(segments, seg)
+		}
+	}
+	return segments
+}
+
+// splitEntry decodes a "duration date project" entry built by hoursForRange.
+// The duration is kept exact, as Duration.String writes it, so summing many
+// short sessions doesn't accumulate rounding error.
+func splitEntry(entry string) (time.Duration, string, string, bool) {
+	parts := strings.SplitN(entry, " ", 3)
+	if len(parts) < 3 || parts[2] == "" {
+		return 0, "", "", false
+	}
+	duration, err := time.ParseDuration(parts[0])
+	if err != nil {
+		return 0, "", "", false
+	}
+	return duration, parts[1], parts[2], true
+}
+
+// totalsByPath sums entry hours per project path, rolling segments deeper
+// than -depth into their parent
+func totalsByPath(entries []string) map[string]float64 {
+	totals := make(map[string]float64)
+	for _, e := range parseEntries(entries) {
+		segments := e.Segments
+		if depth > 0 && len(segments) > depth {
+			segments = segments[:depth]
+		}
+		totals[strings.Join(segments, ":")] += e.Hours
+	}
+	return totals
+}
+
+// reportData is what a -format template is executed against, and what
+// -json prints; reportSchema describes it
+type reportData struct {
+	SchemaVersion int                `json:"schema_version"`
+	Total         float64            `json:"total"`
+	Projects      map[string]float64 `json:"projects"`
+	Entries       []Entry            `json:"entries"`
+}
+
+// reportSchema is the JSON Schema of the -json report. Keep it in step with
+// reportData and Entry, bumping reportSchemaVersion on incompatible changes.
+func reportSchema() map[string]any {
+	number := map[string]any{"type": "number"}
+	text := map[string]any{"type": "string"}
+	entry := map[string]any{
+		"type":     "object",
+		"required": []string{"project", "segments", "hours", "date"},
+		"properties": map[string]any{
+			"project":  text,
+			"segments": map[string]any{"type": "array", "items": text},
+			"hours":    number,
+			"date":     map[string]any{"type": "string", "format": "date"},
+			"note":     text,
+		},
+	}
+	return map[string]any{
+		"$schema":  "https://json-schema.org/draft/2020-12/schema",
+		"$id":      fmt.Sprintf("tt/report/v%d", reportSchemaVersion),
+		"title":    "tt -json report",
+		"type":     "object",
+		"required": []string{"schema_version", "total", "projects", "entries"},
+		"properties": map[string]any{
+			"schema_version": map[string]any{"const": reportSchemaVersion},
+			"total":          number,
+			"projects":       map[string]any{"type": "object", "additionalProperties": number},
+			"entries":        map[string]any{"type": "array", "items": entry},
+		},
+	}
+}
+
+// printSchemas prints the JSON Schema of each JSON output, keyed by name
+func printSchemas() error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]any{"report": reportSchema()})
+}
+
+// printReport writes a period's hours in the selected output style: a
+// -format template, JSON, CSV, the grouped hierarchy, or a single labelled
+// total.
+func printReport(label string, hours float64, entries []string, group bool) error {
+	switch {
+	case reportFormat == "markdown":
+		displayMarkdownTotals(entries)
+	case jsonOutput:
+		return writeReportJSON(hours, entries)
+	case reportFormat != "":
+		return executeReportTemplate(reportFormat, hours, entries)
+	case len(quantiles) > 0:
+		return displayQuantiles(entries)
+	case csvOutput && group:
+		totals := totalsByPath(entries)
+		w := newRowWriter()
+		w.Write([]string{"project", hoursColumn()})
+		for _, path := range slices.Sorted(maps.Keys(totals)) {
+			w.Write([]string{path, hoursValue(totals[path])})
+		}
+		w.Flush()
+		return w.Error()
+	case csvOutput:
+		fmt.Println(hoursColumn())
+		fmt.Println(hoursValue(hours))
+	case group && groupBy == "date":
+		displayDateTotals(entries)
+	case group && groupBy == "note":
+		displayNoteTotals(entries)
+	case group && summaryOnly:
+		displayProjectSummary(entries)
+	case group:
+		DisplayHierTotals(entries)
+	default:
+		total := hoursValue(hours)
+		if minutes {
+			total = formatHours(hours)
+		}
+		if note := openNote(); note != "" {
+			fmt.Printf("%s: %s %s\n", label, total, note)
+		} else {
+			fmt.Printf("%s: %s\n", label, total)
+		}
+	}
+	if len(caps) > 0 && reportFormat == "" && !csvOutput {
+		displayOverCaps(entries)
+	}
+	if (billRate > 0 || rates != nil) && reportFormat == "" && !csvOutput && len(quantiles) == 0 {
+		displayBill(entries)
+	}
+	return nil
+}
+
+// displayBill lists what each top level project's hours come to at its
+// rate, and the total. Projects with no rate are listed without an amount
+// and left out of the total.
+func displayBill(entries []string) {
+	hours := make(map[string]float64)
+	amounts := make(map[string]float64)
+	unrated := make(map[string]bool)
+	var totalHours, totalAmount float64
+	for _, e := range parseEntries(entries) {
+		hours[e.Project] += e.Hours
+		totalHours += e.Hours
+		rate, ok := rateFor(e.Segments)
+		if !ok {
+			unrated[e.Project] = true
+			continue
+		}
+		amounts[e.Project] += e.Hours * rate
+		totalAmount += e.Hours * rate
+	}
+	fmt.Println("Bill:")
+	for _, project := range slices.Sorted(maps.Keys(hours)) {
+		amount := formatAmount(amounts[project])
+		if unrated[project] {
+			amount = "(no rate)"
+			if amounts[project] > 0 {
+				amount = formatAmount(amounts[project]) + " + unrated"
+			}
+		}
+		fmt.Printf("  %-20s %9s %14s\n", project, formatHours(hours[project]), amount)
+	}
+	fmt.Println("--------------------")
+	fmt.Printf("  %-20s %9s %14s\n", "Total", formatHours(totalHours), formatAmount(totalAmount))
+}
+
+// rateFor is the hourly rate of the longest -rate-file project matching a
+// project or one of its parents, otherwise -rate if given
+func rateFor(segments []string) (float64, bool) {
+	for i := len(segments); i > 0; i-- {
+		if rate, ok := rates[strings.Join(segments[:i], ":")]; ok {
+			return rate, true
+		}
+	}
+	return billRate, billRate > 0
+}
+
+// readRateFile reads "project = rate" lines, such as "acme = 120", giving
+// hourly rates in the -currency, skipping blank lines and # comments
+func readRateFile(path string) (map[string]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rates := make(map[string]float64)
+	scanner := newScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		project, value, ok := strings.Cut(line, "=")
+		project = strings.Join(projectSegments(project), ":")
+		if !ok || project == "" {
+			return nil, fmt.Errorf("%s line %d: expected project = rate, got %q", path, lineNum, line)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("%s line %d: invalid rate %q", path, lineNum, strings.TrimSpace(value))
+		}
+		rates[project] = rate
+	}
+	return rates, scanner.Err()
+}
+
+// currencyFormat is how amounts in a currency are written: the symbol and
+// whether it follows the number, the decimal places, and the separators
+// between thousands and before the decimals
+type currencyFormat struct {
+	symbol   string
+	after    bool
+	decimals int
+	group    string
+	point    string
+}
+
+// currencies are the codes -currency knows the conventions of. Any other
+// value is used as a symbol before the amount.
+var currencies = map[string]currencyFormat{
+	"USD": {"$", false, 2, ",", "."},
+	"CAD": {"CA$", false, 2, ",", "."},
+	"AUD": {"A$", false, 2, ",", "."},
+	"GBP": {"£", false, 2, ",", "."},
+	"EUR": {" €", true, 2, ".", ","},
+	"CHF": {"CHF ", false, 2, "'", "."},
+	"JPY": {"¥", false, 0, ",", "."},
+}
+
+// formatAmount writes an amount in the currency setting's format. With no
+// currency it is a plain number to two places, such as 1234.50.
+func formatAmount(amount float64) string {
+	currency := resolveSetting("currency", currencyFlag, "TT_CURRENCY", "").Value
+	f, ok := currencies[strings.ToUpper(currency)]
+	if !ok {
+		f = currencyFormat{decimals: 2, point: "."}
+		if currency != "" {
+			f.symbol = currency + " "
+		}
+	}
+	whole, fraction, _ := strings.Cut(strconv.FormatFloat(amount, 'f', f.decimals, 64), ".")
+	// separate thousands, working back from the units
+	var grouped string
+	for len(whole) > 3 {
+		grouped = f.group + whole[len(whole)-3:] + grouped
+		whole = whole[:len(whole)-3]
+	}
+	number := whole + grouped
+	if fraction != "" {
+		number += f.point + fraction
+	}
+	if f.after {
+		return number + f.symbol
+	}
+	return f.symbol + number
+}
+
+// displayOverCaps lists the -cap projects whose hours, including those of
+// their subprojects, exceed the cap. Projects without a cap are uncapped.
+func displayOverCaps(entries []string) {
+	totals := make(map[string]float64)
+	for _, e := range parseEntries(entries) {
+		for name := range caps {
+			capped := projectSegments(name)
+			if len(e.Segments) >= len(capped) && slices.Equal(e.Segments[:len(capped)], capped) {
+				totals[name] += e.Hours
+			}
+		}
+	}
+	header := false
+	for _, name := range slices.Sorted(maps.Keys(caps)) {
+		if totals[name] <= caps[name] {
+			continue
+		}
+		if !header {
+			fmt.Println("Over cap:")
+			header = true
+		}
+		fmt.Printf("%16s  %s (cap %s, over by %s)\n", formatHours(totals[name]), name, formatHours(caps[name]), formatHours(totals[name]-caps[name]))
+	}
+}
+
+// rowWriter writes the rows of -csv reports
+type rowWriter interface {
+	Write(record []string) error
+	Flush()
+	Error() error
+}
+
+// newRowWriter returns a CSV writer on stdout, or with -tsv one writing tab
+// separated values
+func newRowWriter() rowWriter {
+	if tsvOutput {
+		return tsvWriter{bufio.NewWriter(os.Stdout)}
+	}
+	return csv.NewWriter(os.Stdout)
+}
+
+// tsvWriter writes tab separated rows. Nothing is quoted, so tabs and line
+// breaks within a field are replaced with spaces.
+type tsvWriter struct {
+	w *bufio.Writer
+}
+
+var tsvSanitizer = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+
+func (t tsvWriter) Write(record []string) error {
+	fields := make([]string, len(record))
+	for i, field := range record {
+		fields[i] = tsvSanitizer.Replace(field)
 	}
-	defer f.Close()
-	_, err = f.WriteString(entry)
+	_, err := t.w.WriteString(strings.Join(fields, "\t") + "\n")
 	return err
 }
 
-func alreadyCheckedIn() bool {
-	last, _ := lastEntry()
-	return strings.HasPrefix(last, "i")
-}
+func (t tsvWriter) Flush() { t.w.Flush() }
 
-func alreadyCheckedOut() bool {
-	last, _ := lastEntry()
-	return strings.HasPrefix(last, "o")
+// Error reports any error from an earlier Write or Flush
+func (t tsvWriter) Error() error {
+	_, err := t.w.Write(nil)
+	return err
 }
 
-func lastEntry() (string, error) {
-	f, err := os.Open(getTimelogFile())
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-	var last string
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		last = scanner.Text()
+// parseQuantiles parses a comma separated list of quantiles between 0 and 1
+func parseQuantiles(s string) ([]float64, error) {
+	var qs []float64
+	for field := range strings.SplitSeq(s, ",") {
+		q, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || q < 0 || q > 1 {
+			return nil, fmt.Errorf("invalid quantile %q", field)
+		}
+		qs = append(qs, q)
 	}
-	return last, scanner.Err()
+	return qs, nil
 }
 
-func currentProject() (string, error) {
-	f, err := os.Open(getTimelogFile())
-	if err != nil {
-		return "", err
+// displayQuantiles prints the -quantile session lengths of the report,
+// interpolating between the two nearest sessions
+func displayQuantiles(entries []string) error {
+	var lengths []float64
+	for _, e := range parseEntries(entries) {
+		lengths = append(lengths, e.Hours)
 	}
-	defer f.Close()
-	var lastIn string
-	var lastType string
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "i ") {
-			lastIn = strings.TrimSpace(line[endOfDatePos:])
-			lastType = "i"
-		} else if strings.HasPrefix(line, "o ") {
-			lastType = "o"
+	if len(lengths) == 0 {
+		return errors.New("no sessions in range")
+	}
+	slices.Sort(lengths)
+	var w rowWriter
+	if csvOutput {
+		w = newRowWriter()
+		w.Write([]string{"quantile", hoursColumn()})
+	}
+	for _, q := range quantiles {
+		pos := q * float64(len(lengths)-1)
+		lower := int(pos)
+		value := lengths[lower]
+		if lower+1 < len(lengths) {
+			value += (pos - float64(lower)) * (lengths[lower+1] - value)
+		}
+		if w != nil {
+			w.Write([]string{strconv.FormatFloat(q, 'g', -1, 64), hoursValue(value)})
+		} else {
+			fmt.Printf("%6.0f%% %9s\n", q*100, formatHours(value))
 		}
 	}
-	if lastType != "i" || lastIn == "" {
-		return "", nil
+	if w != nil {
+		w.Flush()
+		return w.Error()
 	}
-	return lastIn, nil
+	fmt.Println("--------------------")
+	fmt.Printf("%d sessions\n", len(lengths))
+	return nil
 }
 
-func editTimelog() error {
-	editor := os.Getenv("EDITOR")
-	if editor == "" {
-		editor = "vi" // fallback if $EDITOR is not set
+// writeReportJSON prints the report data as JSON, indented with
+// -json-pretty. Struct fields keep their declared order and map keys are
+// sorted, so both forms list fields in the same order.
+func writeReportJSON(hours float64, entries []string) error {
+	projects, _ := groupFlatTotals(entries)
+	data := reportData{SchemaVersion: reportSchemaVersion, Total: hours, Projects: projects, Entries: parseEntries(entries)}
+	enc := json.NewEncoder(os.Stdout)
+	if jsonIndent {
+		enc.SetIndent("", "  ")
 	}
-	cmd := exec.Command(editor, getTimelogFile())
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return enc.Encode(data)
 }
 
-func lastProjectN(count int) (string, error) {
-	f, err := os.Open(getTimelogFile())
+// executeReportTemplate runs a text/template over the report. \n and \t in
+// the template are unescaped so formats can be given on the command line.
+func executeReportTemplate(format string, hours float64, entries []string) error {
+	format = strings.NewReplacer(`\n`, "\n", `\t`, "\t").Replace(format)
+	tmpl, err := template.New("format").Parse(format)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("invalid -format template: %w", err)
 	}
-	defer f.Close()
-
-	var lines []string
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+	projects, _ := groupFlatTotals(entries)
+	data := reportData{SchemaVersion: reportSchemaVersion, Total: hours, Projects: projects, Entries: parseEntries(entries)}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return fmt.Errorf("executing -format template: %w", err)
 	}
+	out := buf.String()
+	if !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	fmt.Print(out)
+	return nil
+}
 
-	// Find all "o" entry indices (closed projects)
-	var outIndices []int
-	for i, line := range lines {
-		if strings.HasPrefix(line, "o ") {
-			outIndices = append(outIndices, i)
-		}
+// hierNode is one level of the project hierarchy with its accumulated hours
+type hierNode struct {
+	name     string
+	hours    float64
+	sessions int
+	// statHours is the hours of the sessions counted in sessions
+	statHours float64
+	children  map[string]*hierNode
+}
+
+func (n *hierNode) child(name string) *hierNode {
+	if n.children == nil {
+		n.children = make(map[string]*hierNode)
+	}
+	c, ok := n.children[name]
+	if !ok {
+		c = &hierNode{name: name}
+		n.children[name] = c
 	}
+	return c
+}
 
-	if len(outIndices) < count || count < 1 {
-		return "", errors.New("not enough closed projects")
+// Group and display hierarchically. Segments deeper than -depth are rolled
+// into their parent; a depth of 0 breaks out every level.
+func DisplayHierTotals(entries []string) {
+	root := buildHier(entries)
+	printHierNode(root, 0, "", openHierPath())
+	fmt.Println("--------------------")
+	if countSessions {
+		fmt.Printf("%16s %s\n", formatHours(root.hours), sessionCount(root))
+		return
 	}
+	fmt.Printf("%16s\n", formatHours(root.hours))
+}
 
-	// Get the nth last "o" entry
-	outIdx := outIndices[len(outIndices)-count]
+// displayProjectSummary prints only each top level project's total, most
+// hours first, and the grand total
+func displayProjectSummary(entries []string) {
+	root := buildHier(entries)
+	projects := slices.Collect(maps.Values(root.children))
+	slices.SortStableFunc(projects, func(a, b *hierNode) int {
+		if c := cmp.Compare(b.hours, a.hours); c != 0 {
+			return c
+		}
+		return strings.Compare(a.name, b.name)
+	})
+	for _, p := range projects {
+		fmt.Printf("%16s  %s\n", formatHours(p.hours), p.name)
+	}
+	fmt.Println("--------------------")
+	fmt.Printf("%16s\n", formatHours(root.hours))
+}
 
-	// Find the most recent "i" entry before this "o"
-	var lastIn string
-	for i := outIdx - 1; i >= 0; i-- {
-		if strings.HasPrefix(lines[i], "i ") {
-			lastIn = strings.TrimSpace(lines[i][endOfDatePos:])
-			break
+// displayNoteTotals groups hours by session note rather than by project
+func displayNoteTotals(entries []string) {
+	totals := make(map[string]float64)
+	for _, e := range parseEntries(entries) {
+		note := e.Note
+		if note == "" {
+			note = "(none)"
 		}
+		totals[note] += e.Hours
 	}
+	for _, note := range slices.Sorted(maps.Keys(totals)) {
+		fmt.Printf("%16s  %s\n", formatHours(totals[note]), note)
+	}
+	fmt.Println("--------------------")
+	fmt.Printf("%16s\n", formatHours(sumMap(totals)))
+}
 
-	if lastIn == "" {
-		return "", errors.New("no closed project found for given count")
+// openNote describes the open session time in the last report's total, or
+// is empty when there is none or -q was given
+func openNote() string {
+	if quiet || openIncluded.duration <= 0 {
+		return ""
 	}
-	return lastIn, nil
+	return fmt.Sprintf("(includes %s open session)", formatDuration(openIncluded.duration))
 }
 
-func lastNProjects(n int, exclude string) ([]string, error) {
-	f, err := os.Open(getTimelogFile())
-	if err != nil {
-		return nil, err
+// openHierPath is the path of the grouped line the open session was
+// counted under, after -depth, or "" if there's no open session to note
+func openHierPath() string {
+	if openNote() == "" {
+		return ""
 	}
-	defer f.Close()
-	var allProjects []string
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "i ") {
-			proj := strings.TrimSpace(line[endOfDatePos:])
-			if proj != "" {
-				allProjects = append(allProjects, proj)
-			}
-		}
+	segments := projectSegments(openIncluded.project)
+	if depth > 0 && len(segments) > depth {
+		segments = segments[:depth]
 	}
-	// Reverse for most recent first
-	for i, j := 0, len(allProjects)-1; i < j; i, j = i+1, j-1 {
-		allProjects[i], allProjects[j] = allProjects[j], allProjects[i]
+	return strings.Join(segments, ":")
+}
+
+// displayDateTotals groups hours by day, listing the project tree worked on
+// that day beneath each date
+func displayDateTotals(entries []string) {
+	byDate := make(map[string][]string)
+	for _, entry := range entries {
+		if _, date, _, ok := splitEntry(entry); ok {
+			byDate[date] = append(byDate[date], entry)
+		}
 	}
-	// Deduplicate, preserving order, and exclude if needed
-	unique := []string{}
-	seen := make(map[string]bool)
-	for _, proj := range allProjects {
-		if proj == exclude {
-			continue
+	var total float64
+	for _, date := range slices.Sorted(maps.Keys(byDate)) {
+		root := buildHier(byDate[date])
+		label := date
+		if d, err := time.Parse(dateFormat, date); err == nil {
+			label += " " + d.Weekday().String()[:3]
 		}
-		if !seen[proj] {
-			unique = append(unique, proj)
-			seen[proj] = true
-			if len(unique) == n {
-				break
-			}
+		if countSessions {
+			fmt.Printf("%16s %-25s %s\n", formatHours(root.hours), sessionCount(root), label)
+		} else {
+			fmt.Printf("%16s  %s\n", formatHours(root.hours), label)
+		}
+		open := ""
+		if date == openIncluded.date {
+			open = openHierPath()
 		}
+		printHierNode(root, 1, "", open)
+		total += root.hours
 	}
-	return unique, nil
-}
-
-// Returns hours worked for today
-func hoursToday(group bool) (float64, map[string]float64, map[string]map[string]float64, []string, error) {
-	return hoursForDay(0, group)
+	fmt.Println("--------------------")
+	fmt.Printf("%16s\n", formatHours(total))
 }
 
-func hoursForRange(startDate, endDate string, group bool) (float64, map[string]float64, map[string]map[string]float64, []string, error) {
-	f, err := os.Open(getTimelogFile())
-	if err != nil {
-		return 0, nil, nil, nil, err
-	}
-	defer f.Close()
-
-	var inTimes, outTimes []time.Time
-	var inProjects []string
-
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Fields(line)
-		if len(parts) < 3 {
-			continue
+// printHierNode prints n's children, indented by level, and theirs. With
+// -full-paths each is named by its whole path below parent. The line for
+// the open path notes the open session's share.
+func printHierNode(n *hierNode, level int, parent, open string) {
+	for _, c := range n.sortedChildren() {
+		path := c.name
+		if parent != "" {
+			path = parent + ":" + c.name
 		}
-		date := parts[1]
-		datetime := parts[1] + " " + parts[2]
-		if date < startDate || date > endDate {
-			continue
+		name := c.name
+		if fullPaths {
+			name = path
 		}
-		if strings.HasPrefix(line, "i ") {
-			t, err := time.ParseInLocation(dateTimeFormat, datetime, time.Local)
-			if err == nil {
-				inTimes = append(inTimes, t)
-				project := strings.Join(parts[3:], " ")
-				inProjects = append(inProjects, project)
-			}
+		if path == open {
+			name += " " + openNote()
 		}
-		if strings.HasPrefix(line, "o ") {
-			t, err := time.ParseInLocation(dateTimeFormat, datetime, time.Local)
-			if err == nil {
-				outTimes = append(outTimes, t)
-			}
+		if countSessions {
+			fmt.Printf("%16s %-25s %s%s\n", formatHours(c.hours), sessionCount(c), strings.Repeat("  ", level), name)
+		} else {
+			fmt.Printf("%16s  %s%s\n", formatHours(c.hours), strings.Repeat("  ", level), name)
 		}
+		printHierNode(c, level+1, path, open)
 	}
+}
 
-	// Only append time.Now() if there is one more in than out
-	lastType, _ := lastEntryType()
-	today := time.Now().Format(dateFormat)
-	if lastType == "i" && today >= startDate && today <= endDate && len(inTimes) == len(outTimes)+1 {
-		outTimes = append(outTimes, time.Now())
+// displayGoalBar draws progress towards the weekly goal from -goal,
+// TT_WEEK_GOAL or the week_goal setting, sized to the terminal, such as
+// [#######---] 32.50/40h (81%). Nothing is drawn without a goal.
+func displayGoalBar(hours float64) error {
+	value := resolveSetting("week_goal", weekGoalFlag, "TT_WEEK_GOAL", "").Value
+	if value == "" {
+		return nil
+	}
+	goal, err := strconv.ParseFloat(value, 64)
+	if err != nil || goal <= 0 {
+		return fmt.Errorf("invalid weekly goal %q, expected hours such as 40", value)
 	}
+	target := strconv.FormatFloat(goal, 'g', -1, 64) + "h"
+	if minutes {
+		target = formatHours(goal)
+	}
+	label := fmt.Sprintf(" %s/%s (%.0f%%)", hoursValue(hours), target, 100*hours/goal)
+	if hours > goal {
+		label = fmt.Sprintf(" %s/%s (%.0f%%, %s over)", hoursValue(hours), target, 100*hours/goal, formatHours(hours-goal))
+	}
+	width := max(10, terminalWidth()-len(label)-2)
+	filled := int(math.Round(float64(width) * min(hours/goal, 1)))
+	fmt.Printf("[%s%s]%s\n", strings.Repeat("#", filled), strings.Repeat("-", width-filled), label)
+	return nil
+}
 
-	var entries []string
-	var total float64
-	// Only pair up to the minimum of inTimes and outTimes
-	n := min(len(outTimes), len(inTimes))
-	for i := range n {
-		dur := outTimes[i].Sub(inTimes[i])
-		if dur > 0 {
-			total += dur.Hours()
-			entries = append(entries, fmt.Sprintf("%f %s", dur.Hours(), inProjects[i]))
+// terminalWidth is the width of the terminal from $COLUMNS or stty, or 80
+// when neither says
+func terminalWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	if out, err := cmd.Output(); err == nil {
+		var rows, cols int
+		if _, err := fmt.Sscanf(string(out), "%d %d", &rows, &cols); err == nil && cols > 0 {
+			return cols
 		}
 	}
+	return 80
+}
 
-	if group {
-		projectTotals, projectPaths := groupFlatTotals(entries)
-		return total, projectTotals, projectPaths, entries, nil
+// formatHours renders a report total as hours to two places, such as
+// 1.50h, or with -minutes as whole minutes, such as 90m
+func formatHours(h float64) string {
+	if minutes {
+		return hoursValue(h) + "m"
 	}
-	return total, nil, nil, entries, nil
+	return hoursValue(h) + "h"
 }
 
-func hoursForDay(daysAgo int, group bool) (float64, map[string]float64, map[string]map[string]float64, []string, error) {
-	targetDate := time.Now().AddDate(0, 0, -daysAgo).Format(dateFormat)
-	return hoursForRange(targetDate, targetDate, group)
+// signedHours is formatHours with a sign, such as +1.50h or -30m
+func signedHours(h float64) string {
+	if h < 0 {
+		return formatHours(h)
+	}
+	return "+" + formatHours(h)
 }
 
-func hoursThisWeek(group bool) (float64, map[string]float64, map[string]map[string]float64, []string, error) {
-	now := time.Now()
-	offset := int(now.Weekday())
-	if offset == 0 {
-		offset = 6
-	} else {
-		offset = offset - 1
+// hoursValue is formatHours without the unit, for CSV and table columns
+// headed by hoursColumn
+func hoursValue(h float64) string {
+	if minutes {
+		return strconv.Itoa(int(math.Round(h * 60)))
 	}
-	monday := now.AddDate(0, 0, -offset)
-	sunday := monday.AddDate(0, 0, 6)
-	return hoursForRange(monday.Format(dateFormat), sunday.Format(dateFormat), group)
+	return fmt.Sprintf("%.2f", h)
 }
 
-func hoursForWeek(weeksAgo int, group bool) (float64, map[string]float64, map[string]map[string]float64, []string, error) {
-	now := time.Now()
-	offset := int(now.Weekday())
-	if offset == 0 {
-		offset = 6
-	} else {
-		offset = offset - 1
+// hoursColumn heads a column of hoursValue figures
+func hoursColumn() string {
+	if minutes {
+		return "minutes"
 	}
-	monday := now.AddDate(0, 0, -offset-7*weeksAgo)
-	sunday := monday.AddDate(0, 0, 6)
-	return hoursForRange(monday.Format(dateFormat), sunday.Format(dateFormat), group)
+	return "hours"
 }
 
-func groupFlatTotals(entries []string) (map[string]float64, map[string]map[string]float64) {
-	projectTotals := make(map[string]float64)
-	projectPaths := make(map[string]map[string]float64)
-	for _, entry := range entries {
-		parts := strings.Fields(entry)
-		if len(parts) < 2 {
-			continue
-		}
-		project := strings.Split(parts[1], ":")[0]
-		path := parts[1]
-		duration, err := time.ParseDuration(parts[0] + "h")
-		if err != nil {
-			continue
+// sessionCount describes the sessions counted in n, and their average
+// length, for -count-sessions
+func sessionCount(n *hierNode) string {
+	switch n.sessions {
+	case 0:
+		return "(0 sessions)"
+	case 1:
+		return fmt.Sprintf("(1 session, %s avg)", formatHours(n.statHours))
+	}
+	return fmt.Sprintf("(%d sessions, %s avg)", n.sessions, formatHours(n.statHours/float64(n.sessions)))
+}
+
+// buildHier totals entries into a project tree, rolling segments deeper
+// than -depth into their parent
+func buildHier(entries []string) *hierNode {
+	root := &hierNode{}
+	for _, e := range parseEntries(entries) {
+		segments := e.Segments
+		if depth > 0 && len(segments) > depth {
+			segments = segments[:depth]
 		}
-		hours := duration.Hours()
-		projectTotals[project] += hours
-		if projectPaths[project] == nil {
-			projectPaths[project] = make(map[string]float64)
+		counted := time.Duration(e.Hours*float64(time.Hour)) >= minSessionForStats
+		root.add(e.Hours, counted)
+		node := root
+		for _, seg := range segments {
+			node = node.child(seg)
+			node.add(e.Hours, counted)
 		}
-		projectPaths[project][path] += hours
 	}
-	return projectTotals, projectPaths
+	return root
 }
 
-// Parse entries into structured data
-func parseEntries(entries []string) []Entry {
-	var result []Entry
-	for _, entry := range entries {
-		parts := strings.Fields(entry)
-		if len(parts) < 2 {
+// add totals a session's hours into n, also counting it towards the session
+// stats if counted
+func (n *hierNode) add(hours float64, counted bool) {
+	n.hours += hours
+	if counted {
+		n.sessions++
+		n.statHours += hours
+	}
+}
+
+func (n *hierNode) sortedChildren() []*hierNode {
+	children := slices.Collect(maps.Values(n.children))
+	slices.SortFunc(children, func(a, b *hierNode) int { return strings.Compare(a.name, b.name) })
+	return children
+}
+
+// displayProjectTree prints every project path ever clocked into as an
+// indented tree, siblings sorted alphabetically. Given days, each node also
+// shows its hours over that many days up to today. With -ignore-case,
+// segments differing only in case share a node, which lists the spellings.
+func displayProjectTree(days int) error {
+	root := &hierNode{}
+	spellings := make(map[*hierNode][]string)
+	add := func(segments []string, hours float64) {
+		node := root
+		for _, seg := range segments {
+			key := seg
+			if ignoreCase {
+				key = strings.ToLower(seg)
+			}
+			node = node.child(key)
+			node.hours += hours
+			if !slices.Contains(spellings[node], seg) {
+				spellings[node] = append(spellings[node], seg)
+			}
+		}
+	}
+
+	f, err := openTimelog()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := newScanner(f)
+	for scanner.Scan() {
+		line := trimLine(scanner.Text())
+		if !strings.HasPrefix(line, "i ") {
 			continue
 		}
-		segments := strings.Split(parts[1], ":")
-		duration, err := time.ParseDuration(parts[0] + "h")
+		project, _ := entryProject(line)
+		add(projectSegments(project), 0)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if days > 0 {
+		start := reportNow().AddDate(0, 0, 1-days).Format(dateFormat)
+		_, _, _, entries, err := hoursForRange(start, reportNow().Format(dateFormat), false)
 		if err != nil {
-			continue
+			return err
+		}
+		for _, e := range parseEntries(entries) {
+			add(e.Segments, e.Hours)
 		}
-		result = append(result, Entry{
-			Project:  segments[0],
-			Segments: segments,
-			Hours:    duration.Hours(),
-		})
 	}
-	return result
-}
 
-// Group and display hierarchically
-func DisplayHierTotals(entries []string) {
-	parsed := parseEntries(entries)
-	projectTotals := make(map[string]float64)
-	subTotals := make(map[string]map[string]float64)
-	subSubTotals := make(map[string]map[string]float64)
-
-	for _, e := range parsed {
-		projectTotals[e.Project] += e.Hours
-		if len(e.Segments) > 1 {
-			sub := e.Segments[1]
-			if subTotals[e.Project] == nil {
-				subTotals[e.Project] = make(map[string]float64)
+	var walk func(n *hierNode, level int)
+	walk = func(n *hierNode, level int) {
+		for _, c := range n.sortedChildren() {
+			name := spellings[c][0]
+			if len(spellings[c]) > 1 {
+				name += " (" + strings.Join(spellings[c], ", ") + ")"
 			}
-			subTotals[e.Project][sub] += e.Hours
-			if len(e.Segments) > 2 {
-				path := strings.Join(e.Segments[2:], ":")
-				if subSubTotals[sub] == nil {
-					subSubTotals[sub] = make(map[string]float64)
-				}
-				subSubTotals[sub][path] += e.Hours
+			if days > 0 {
+				fmt.Printf("%16s  ", formatHours(c.hours))
 			}
+			fmt.Printf("%s%s\n", strings.Repeat("  ", level), name)
+			walk(c, level+1)
 		}
 	}
+	walk(root, 0)
+	return nil
+}
 
-	for project, total := range projectTotals {
-		fmt.Printf("%15.2fh  %s\n", total, project)
-		for sub, subTotal := range subTotals[project] {
-			fmt.Printf("%15.2fh    %s\n", subTotal, sub)
-			for path, pathTotal := range subSubTotals[sub] {
-				fmt.Printf("%15.2fh      %s\n", pathTotal, path)
-			}
+// displayMarkdownTotals renders the project tree as a Markdown table, with
+// sub-projects as indented rows and a closing total row
+func displayMarkdownTotals(entries []string) {
+	root := buildHier(entries)
+	type row struct {
+		project string
+		hours   string
+	}
+	var rows []row
+	var walk func(n *hierNode, level int)
+	walk = func(n *hierNode, level int) {
+		for _, c := range n.sortedChildren() {
+			name := strings.Repeat("&nbsp;&nbsp;", level) + strings.ReplaceAll(c.name, "|", "\\|")
+			rows = append(rows, row{name, hoursValue(c.hours)})
+			walk(c, level+1)
 		}
 	}
-	fmt.Println("--------------------")
-	fmt.Printf("%15.2fh\n", sumMap(projectTotals))
+	walk(root, 0)
+	rows = append(rows, row{"**Total**", "**" + hoursValue(root.hours) + "**"})
+
+	heading := "Hours"
+	if minutes {
+		heading = "Minutes"
+	}
+	pw, hw := len("Project"), len(heading)
+	for _, r := range rows {
+		pw = max(pw, len(r.project))
+		hw = max(hw, len(r.hours))
+	}
+	fmt.Printf("| %-*s | %*s |\n", pw, "Project", hw, heading)
+	fmt.Printf("|%s|%s:|\n", strings.Repeat("-", pw+2), strings.Repeat("-", hw+1))
+	for _, r := range rows {
+		fmt.Printf("| %-*s | %*s |\n", pw, r.project, hw, r.hours)
+	}
 }
 
 func sumMap(m map[string]float64) float64 {
@@ -755,108 +5346,125 @@ func sumMap(m map[string]float64) float64 {
 
 // paran days: number of days to include, if days is 0, include all
 func CatInEntries(days int) error {
-	file, err := os.Open(getTimelogFile())
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	var entries []string
-	daySet := make(map[string]struct{})
-	var daysList []string
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Fields(line)
-		if len(parts) < 3 || parts[0] != "i" {
-			continue
-		}
-		date := parts[1][:10]
-		entries = append(entries, line)
-		if _, exists := daySet[date]; !exists {
-			daysList = append(daysList, date)
-			daySet[date] = struct{}{}
-		}
-	}
-	if err := scanner.Err(); err != nil {
-		return err
-	}
-
-	if days > len(daysList) || days == 0 {
-		days = len(daysList)
-	}
-	lastDays := daysList[len(daysList)-days:]
-
-	for _, entry := range entries {
-		parts := strings.Fields(entry)
-		date := parts[1][:10]
-		if slices.Contains(lastDays, date) {
-			fmt.Println(entry)
-		}
-	}
-	return nil
+	return catEntries(days, true)
 }
 
 // paran days: number of days to include, if days is 0, include all
 func CatAllEntries(days int) error {
-	file, err := os.Open(getTimelogFile())
+	return catEntries(days, false)
+}
+
+// catEntries prints the entries for the last days distinct dates in
+// chronological order. It streams the file, keeping only the lines for the
+// dates still in the window, so large logs aren't held in memory.
+func catEntries(days int, inOnly bool) error {
+	file, err := openTimelog()
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	var entries []string
-	daySet := make(map[string]struct{})
-	var daysList []string
+	type datedLine struct {
+		date string
+		line string
+	}
+	var window []datedLine
+	var windowDays []string
+	dropped := make(map[string]struct{})
 
-	scanner := bufio.NewScanner(file)
+	scanner := newScanner(file)
 	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Fields(line)
-		date := parts[1][:10]
-		entries = append(entries, line)
-		if _, exists := daySet[date]; !exists {
-			daysList = append(daysList, date)
-			daySet[date] = struct{}{}
+		line := trimLine(scanner.Text())
+		t, err := entryTime(line)
+		if err != nil || (inOnly && !strings.HasPrefix(line, "i ")) {
+			continue
 		}
+		date := t.Format(dateFormat)
+		if _, gone := dropped[date]; gone {
+			continue
+		}
+		if !slices.Contains(windowDays, date) {
+			windowDays = append(windowDays, date)
+			if days > 0 && len(windowDays) > days {
+				oldest := windowDays[0]
+				windowDays = windowDays[1:]
+				dropped[oldest] = struct{}{}
+				window = slices.DeleteFunc(window, func(d datedLine) bool { return d.date == oldest })
+			}
+		}
+		window = append(window, datedLine{date, line})
 	}
 	if err := scanner.Err(); err != nil {
 		return err
 	}
 
-	if days > len(daysList) || days == 0 {
-		days = len(daysList)
-	}
-	lastDays := daysList[len(daysList)-days:]
-
-	for _, entry := range entries {
-		parts := strings.Fields(entry)
-		date := parts[1][:10]
-		if slices.Contains(lastDays, date) {
-			fmt.Println(entry)
+	for _, d := range window {
+		line := d.line
+		if t, tail, err := parseEntryLine(line); err == nil && displayZone != nil {
+			line = line[:2] + displayTime(t).Format(dateTimeFormat) + tail
 		}
+		fmt.Println(line)
 	}
 	return nil
 }
 
 func lastEntryType() (string, error) {
-	f, err := os.Open(getTimelogFile())
+	f, err := openTimelog()
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 	var lastType string
-	scanner := bufio.NewScanner(f)
+	scanner := newScanner(f)
 	for scanner.Scan() {
-		line := scanner.Text()
+		line := trimLine(scanner.Text())
 		if strings.HasPrefix(line, "i ") {
 			lastType = "i"
 		} else if strings.HasPrefix(line, "o ") {
 			lastType = "o"
 		}
 	}
-	return lastType, nil
+	return lastType, scanner.Err()
+}
+
+// parseClockTime parses an HH:MM or HH:MM:SS time of day as a time today
+func parseClockTime(s string) (time.Time, error) {
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			y, m, d := reportNow().Date()
+			return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, time.Local), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected HH:MM", s)
+}
+
+// entryProject returns the project and note of an i line. As in ledger's
+// timeclock format, a note follows the project after two or more spaces.
+func entryProject(line string) (string, string) {
+	_, rest, err := parseEntryLine(line)
+	if err != nil {
+		return "", ""
+	}
+	return splitProjectNote(rest)
+}
+
+func splitProjectNote(s string) (string, string) {
+	project, note, _ := strings.Cut(s, "  ")
+	return strings.TrimSpace(project), strings.TrimSpace(note)
+}
+
+// trimLine strips trailing whitespace, including the '\r' left behind by
+// CRLF line endings, so lines edited on Windows parse the same as on Unix.
+func trimLine(s string) string {
+	return strings.TrimRight(s, " \t\r")
+}
+
+// newScanner reads r line by line, allowing lines up to maxLineLength
+// rather than bufio's 64KB so a long note doesn't stop the read part way
+func newScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength)
+	return scanner
 }
 
 func isInteger(s string) bool {
@@ -864,6 +5472,12 @@ func isInteger(s string) bool {
 	return err == nil
 }
 
+// isDate reports whether s is a date such as 2024-01-01
+func isDate(s string) bool {
+	_, err := time.Parse(dateFormat, s)
+	return err == nil
+}
+
 func getTrailingCaratCount(s string) int {
 	count := 0
 	for i := len(s) - 1; i >= 0 && s[i] == '^'; i-- {
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// runTT runs the test binary as tt itself
+	if os.Getenv("TT_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	// Keep any real config and timelog out of the tests
+	os.Setenv("TT_CONFIG", filepath.Join(os.TempDir(), "tt-test-no-config"))
+	os.Unsetenv("TIMELOG")
+	os.Unsetenv("TT_HOOK")
+	os.Exit(m.Run())
+}
+
+// runTT runs tt with args against the timelog at path, found through
+// TIMELOG so the arguments are parsed exactly as given
+func runTT(t *testing.T, path string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "TT_TEST_MAIN=1", "TIMELOG="+path)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("tt %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// useTimelog writes content to a temporary timelog and points tt at it for
+// the rest of the test
+func useTimelog(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "timelog.txt")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := timeLogFile
+	timeLogFile = path
+	t.Cleanup(func() { timeLogFile = old })
+	return path
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestShiftDay(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		keep     bool
+		log      string
+		want     string
+		wantErr  string
+	}{
+		{
+			name: "sessions either side of one on the target date",
+			from: "2024-02-10", to: "2024-02-11",
+			log: `i 2024-02-10 09:00:00 a
+o 2024-02-10 10:00:00
+i 2024-02-10 14:00:00 a
+o 2024-02-10 15:00:00
+i 2024-02-11 12:00:00 b
+o 2024-02-11 13:00:00
+`,
+			want: `i 2024-02-11 09:00:00 a
+o 2024-02-11 10:00:00
+i 2024-02-11 12:00:00 b
+o 2024-02-11 13:00:00
+i 2024-02-11 14:00:00 a
+o 2024-02-11 15:00:00
+`,
+		},
+		{
+			name: "clone around a session on the target date",
+			from: "2024-02-10", to: "2024-02-11",
+			keep: true,
+			log: `i 2024-02-10 09:00:00 a
+o 2024-02-10 10:00:00
+i 2024-02-10 14:00:00 a
+o 2024-02-10 15:00:00
+i 2024-02-11 12:00:00 b
+o 2024-02-11 13:00:00
+`,
+			want: `i 2024-02-10 09:00:00 a
+o 2024-02-10 10:00:00
+i 2024-02-10 14:00:00 a
+o 2024-02-10 15:00:00
+i 2024-02-11 09:00:00 a
+o 2024-02-11 10:00:00
+i 2024-02-11 12:00:00 b
+o 2024-02-11 13:00:00
+i 2024-02-11 14:00:00 a
+o 2024-02-11 15:00:00
+`,
+		},
+		{
+			name: "clone onto a date with an open session",
+			from: "2024-02-09", to: "2024-02-10",
+			keep: true,
+			log: `i 2024-02-09 09:00:00 a
+o 2024-02-09 10:00:00
+i 2024-02-10 08:00:00 c
+`,
+			wantErr: "would overlap",
+		},
+		{
+			name: "shift onto a date with an open session",
+			from: "2024-02-09", to: "2024-02-10",
+			log: `i 2024-02-09 09:00:00 a
+o 2024-02-09 10:00:00
+i 2024-02-10 08:00:00 c
+`,
+			wantErr: "would overlap",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := useTimelog(t, tt.log)
+			err := shiftDay(tt.from, tt.to, tt.keep)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				if got := readFile(t, path); got != tt.log {
+					t.Errorf("log changed on error:\n%s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readFile(t, path); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPruneDuplicates(t *testing.T) {
+	tests := []struct {
+		name    string
+		log     string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "a session repeated by a merge",
+			log: `i 2024-02-10 09:00:00 a
+o 2024-02-10 10:00:00
+i 2024-02-10 09:00:00 a
+o 2024-02-10 10:00:00
+`,
+			want: `i 2024-02-10 09:00:00 a
+o 2024-02-10 10:00:00
+`,
+		},
+		{
+			name: "two sessions closing in the same second",
+			log: `i 2024-02-10 09:00:00 a
+o 2024-02-10 10:00:00
+i 2024-02-10 10:00:00 b
+o 2024-02-10 10:00:00
+`,
+			wantErr: "not whole sessions",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := useTimelog(t, tt.log)
+			err := pruneDuplicates()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				if got := readFile(t, path); got != tt.log {
+					t.Errorf("log changed on error:\n%s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readFile(t, path); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelativeDay(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no zoneinfo:", err)
+	}
+	oldLocal, oldAsOf := time.Local, asOf
+	t.Cleanup(func() { time.Local, asOf = oldLocal, oldAsOf })
+	time.Local = ny
+	// DST began on 2024-03-10, so that day was 23 hours long
+	asOf = time.Date(2024, 3, 11, 10, 0, 0, 0, ny)
+	tests := []struct {
+		at   time.Time
+		want string
+	}{
+		{time.Date(2024, 3, 11, 9, 0, 0, 0, ny), "today"},
+		{time.Date(2024, 3, 10, 9, 0, 0, 0, ny), "yesterday"},
+		{time.Date(2024, 3, 9, 23, 0, 0, 0, ny), "last Sat"},
+		{time.Date(2024, 3, 5, 9, 0, 0, 0, ny), "last Tue"},
+		{time.Date(2024, 3, 4, 9, 0, 0, 0, ny), "2024-03-04"},
+	}
+	for _, tt := range tests {
+		if got := relativeDay(tt.at); got != tt.want {
+			t.Errorf("relativeDay(%s) = %q, want %q", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestHoursForRange(t *testing.T) {
+	var many strings.Builder
+	start := time.Date(2024, 2, 10, 9, 0, 0, 0, time.Local)
+	for i := range 500 {
+		in := start.Add(time.Duration(i) * time.Minute)
+		fmt.Fprintf(&many, "i %s a\no %s\n", in.Format(dateTimeFormat), in.Add(37*time.Second).Format(dateTimeFormat))
+	}
+	tests := []struct {
+		name string
+		log  string
+		want map[string]time.Duration
+	}{
+		{
+			name: "CRLF line endings and trailing spaces",
+			log:  "i 2024-02-10 09:00:00 acme  \r\no 2024-02-10 10:30:00\r\ni 2024-02-10 11:00:00 other\r\no 2024-02-10 11:15:00 \r\n",
+			want: map[string]time.Duration{"acme": 90 * time.Minute, "other": 15 * time.Minute},
+		},
+		{
+			name: "shuffled file",
+			log: `o 2024-02-10 12:00:00
+i 2024-02-10 13:00:00 b
+i 2024-02-10 09:00:00 a
+o 2024-02-10 14:30:00
+o 2024-02-10 10:00:00
+i 2024-02-10 11:00:00 b
+`,
+			want: map[string]time.Duration{"a": time.Hour, "b": 150 * time.Minute},
+		},
+		{
+			name: "many 37 second sessions",
+			log:  many.String(),
+			want: map[string]time.Duration{"a": 500 * 37 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTimelog(t, tt.log)
+			total, projects, _, _, err := hoursForRange("2024-02-10", "2024-02-10", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want time.Duration
+			for project, d := range tt.want {
+				want += d
+				if got := projects[project]; got != d.Hours() {
+					t.Errorf("%s: got %vh, want %vh", project, got, d.Hours())
+				}
+			}
+			if len(projects) != len(tt.want) {
+				t.Errorf("got projects %v, want %v", projects, tt.want)
+			}
+			if total != want.Hours() {
+				t.Errorf("total: got %vh, want %vh", total, want.Hours())
+			}
+		})
+	}
+}
+
+func TestValidateTimelogFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		log    string
+		issues int
+	}{
+		{"CRLF line endings", "i 2024-02-10 09:00:00 acme\r\no 2024-02-10 10:00:00\r\n", 0},
+		{"trailing spaces", "i 2024-02-10 09:00:00 acme   \no 2024-02-10 10:00:00 \t\n", 0},
+		{"out of order", "i 2024-02-10 09:00:00 acme\no 2024-02-10 08:00:00\n", 1},
+	}
+	oldStrict, oldIssues, oldMax := strict, strictIssues, maxIssues
+	t.Cleanup(func() { strict, strictIssues, maxIssues = oldStrict, oldIssues, oldMax })
+	strict, maxIssues = true, 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := useTimelog(t, tt.log)
+			strictIssues = 0
+			if err := validateTimelogFile(path); err != nil {
+				t.Fatal(err)
+			}
+			if strictIssues != tt.issues {
+				t.Errorf("got %d issues, want %d", strictIssues, tt.issues)
+			}
+		})
+	}
+}
+
+func TestLastProjectN(t *testing.T) {
+	tests := []struct {
+		name string
+		log  string
+		want string
+	}{
+		{
+			name: "empty project before the out",
+			log: `i 2024-02-10 09:00:00 acme
+o 2024-02-10 10:00:00
+i 2024-02-10 11:00:00
+o 2024-02-10 12:00:00
+`,
+			want: "acme",
+		},
+		{
+			name: "malformed time before the out",
+			log: `i 2024-02-10 09:00:00 acme
+o 2024-02-10 10:00:00
+i 2024-02-10 1x:00:00 other
+o 2024-02-10 12:00:00
+`,
+			want: "acme",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTimelog(t, tt.log)
+			got, err := lastProjectN(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClockInProjectName(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"year-like project", []string{"in", "2024"}, "2024"},
+		{"small number project", []string{"in", "3"}, "3"},
+		{"date-like project", []string{"in", "2024-01-01"}, "2024-01-01"},
+		{"extra spaces", []string{"in", "  a   b  "}, "a b"},
+		{"several words", []string{"in", "code", "review"}, "code review"},
+		{"levels with -sub", []string{"in", "-sub", "acme", "dev"}, "acme:dev"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "timelog.txt")
+			runTT(t, path, tt.args...)
+			lines := strings.Split(strings.TrimSpace(readFile(t, path)), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("got log %q, want one in line", lines)
+			}
+			if got, _ := entryProject(lines[0]); got != tt.want {
+				t.Errorf("got project %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunningTotalMatchesWeek(t *testing.T) {
+	tests := []struct {
+		name string
+		log  string
+	}{
+		{"open since an earlier day", "i 2024-02-12 09:00:00 a\no 2024-02-12 17:00:00\ni 2024-02-13 09:00:00 b\n"},
+		{"open since today", "i 2024-02-12 09:00:00 a\no 2024-02-12 17:00:00\ni 2024-02-15 09:00:00 b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := useTimelog(t, tt.log)
+			asOf := []string{"-as-of", "2024-02-15 12:00"}
+			week := strings.Fields(runTT(t, path, append(asOf, "tw")...))
+			days := strings.Split(strings.TrimSpace(runTT(t, path, append(asOf, "tw", "-daily", "-running-total")...)), "\n")
+			var last string
+			for _, line := range days {
+				if fields := strings.Fields(line); len(fields) == 4 && isDate(fields[0]) {
+					last = fields[3]
+				}
+			}
+			if want := week[len(week)-1]; last != want {
+				t.Errorf("last running total %s, want the week's total %s", last, want)
+			}
+		})
+	}
+}
+
+func TestHoursForRangeEdges(t *testing.T) {
+	tests := []struct {
+		name            string
+		log             string
+		start, end      string
+		excludeWeekends bool
+		want            time.Duration
+	}{
+		{
+			name: "session crossing into the week",
+			log: `i 2024-02-11 23:00:00 night
+o 2024-02-12 01:00:00
+i 2024-02-12 09:00:00 day
+o 2024-02-12 10:00:00
+`,
+			start: "2024-02-12", end: "2024-02-18",
+			want: 2 * time.Hour,
+		},
+		{
+			name: "session crossing into the week, weekends excluded",
+			log: `i 2024-02-11 23:00:00 night
+o 2024-02-12 01:00:00
+i 2024-02-12 09:00:00 day
+o 2024-02-12 10:00:00
+`,
+			start: "2024-02-12", end: "2024-02-18",
+			excludeWeekends: true,
+			want:            2 * time.Hour,
+		},
+		{
+			name: "shuffled file with a session starting before the range",
+			log: `i 2024-02-12 11:00:00 b
+o 2024-02-12 01:00:00
+o 2024-02-12 12:00:00
+i 2024-02-11 23:00:00 a
+`,
+			start: "2024-02-12", end: "2024-02-12",
+			want: 2 * time.Hour,
+		},
+		{
+			name: "two ins in a row",
+			log: `i 2024-02-12 09:00:00 a
+i 2024-02-12 11:00:00 b
+o 2024-02-12 12:00:00
+i 2024-02-12 13:00:00 c
+o 2024-02-12 14:00:00
+`,
+			start: "2024-02-12", end: "2024-02-12",
+			want: 2 * time.Hour,
+		},
+		{
+			name: "session crossing out of the week",
+			log: `i 2024-02-16 09:00:00 day
+o 2024-02-16 10:00:00
+i 2024-02-18 23:00:00 night
+o 2024-02-19 01:00:00
+`,
+			start: "2024-02-12", end: "2024-02-18",
+			want: 2 * time.Hour,
+		},
+	}
+	oldExclude := excludeWeekends
+	t.Cleanup(func() { excludeWeekends = oldExclude })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTimelog(t, tt.log)
+			excludeWeekends = tt.excludeWeekends
+			total, _, _, _, err := hoursForRange(tt.start, tt.end, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != tt.want.Hours() {
+				t.Errorf("got %vh, want %vh", total, tt.want.Hours())
+			}
+		})
+	}
+}
+
+func TestBackupTimelogKeepsEarlierBackups(t *testing.T) {
+	path := useTimelog(t, "i 2024-02-10 09:00:00 a\no 2024-02-10 10:00:00\n")
+	first, err := backupTimelog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("i 2024-02-10 09:00:00 b\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// within the same second, so both want the same name
+	second, err := backupTimelog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("both backups written to %s", first)
+	}
+	if got := readFile(t, first); !strings.Contains(got, " a\n") {
+		t.Errorf("first backup overwritten: %q", got)
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	defer func(c string) { currencyFlag = c }(currencyFlag)
+	tests := []struct {
+		currency string
+		amount   float64
+		want     string
+	}{
+		{"", 1234.5, "1234.50"},
+		{"USD", 1234567.891, "$1,234,567.89"},
+		{"eur", 1234.5, "1.234,50 €"},
+		{"JPY", 1234.5, "¥1,234"},
+		{"CHF", 999.999, "CHF 1'000.00"},
+		{"kr", 12, "kr 12.00"},
+	}
+	for _, tt := range tests {
+		currencyFlag = tt.currency
+		if got := formatAmount(tt.amount); got != tt.want {
+			t.Errorf("formatAmount(%v) with %q = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}